@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package awsutils
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func statAvailableDiskSpace(dir string) (uint64, error) {
+	return 0, fmt.Errorf("Disk space check not supported on %s", runtime.GOOS)
+}
@@ -1,8 +1,8 @@
 module awsutils
 
-go 1.12
+go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.23.21
-	golang.org/x/net v0.0.0-20190912160710-24e19bdeb0f2 // indirect
+	github.com/BurntSushi/toml v0.3.1
+	github.com/aws/aws-sdk-go v1.44.100
 )
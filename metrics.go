@@ -0,0 +1,210 @@
+package awsutils
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+)
+
+//MetricsHook ... observes the duration and result of every AWS call made by a Stack or a Bucket,
+//op is the name of the SDK operation (e.g. CreateStack)
+type MetricsHook interface {
+	Observe(op string, d time.Duration, err error)
+}
+
+func observe(hook MetricsHook, op string, start time.Time, err error) {
+	hook.Observe(op, time.Since(start), err)
+}
+
+// observedCloudFormation reports the calls used by Stack to a MetricsHook.
+type observedCloudFormation struct {
+	cloudformationiface.CloudFormationAPI
+	hook MetricsHook
+}
+
+func (o observedCloudFormation) CancelUpdateStack(in *cloudformation.CancelUpdateStackInput) (out *cloudformation.CancelUpdateStackOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "CancelUpdateStack", start, err) }(time.Now())
+	return o.CloudFormationAPI.CancelUpdateStack(in)
+}
+func (o observedCloudFormation) CreateChangeSetWithContext(ctx aws.Context, in *cloudformation.CreateChangeSetInput, opts ...request.Option) (out *cloudformation.CreateChangeSetOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "CreateChangeSet", start, err) }(time.Now())
+	return o.CloudFormationAPI.CreateChangeSetWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) CreateStackWithContext(ctx aws.Context, in *cloudformation.CreateStackInput, opts ...request.Option) (out *cloudformation.CreateStackOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "CreateStack", start, err) }(time.Now())
+	return o.CloudFormationAPI.CreateStackWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) DeleteChangeSetWithContext(ctx aws.Context, in *cloudformation.DeleteChangeSetInput, opts ...request.Option) (out *cloudformation.DeleteChangeSetOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DeleteChangeSet", start, err) }(time.Now())
+	return o.CloudFormationAPI.DeleteChangeSetWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) DeleteStack(in *cloudformation.DeleteStackInput) (out *cloudformation.DeleteStackOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DeleteStack", start, err) }(time.Now())
+	return o.CloudFormationAPI.DeleteStack(in)
+}
+func (o observedCloudFormation) DescribeChangeSetWithContext(ctx aws.Context, in *cloudformation.DescribeChangeSetInput, opts ...request.Option) (out *cloudformation.DescribeChangeSetOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DescribeChangeSet", start, err) }(time.Now())
+	return o.CloudFormationAPI.DescribeChangeSetWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) DescribeStackEventsWithContext(ctx aws.Context, in *cloudformation.DescribeStackEventsInput, opts ...request.Option) (out *cloudformation.DescribeStackEventsOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DescribeStackEvents", start, err) }(time.Now())
+	return o.CloudFormationAPI.DescribeStackEventsWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) DescribeStackResources(in *cloudformation.DescribeStackResourcesInput) (out *cloudformation.DescribeStackResourcesOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DescribeStackResources", start, err) }(time.Now())
+	return o.CloudFormationAPI.DescribeStackResources(in)
+}
+func (o observedCloudFormation) DescribeStacks(in *cloudformation.DescribeStacksInput) (out *cloudformation.DescribeStacksOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DescribeStacks", start, err) }(time.Now())
+	return o.CloudFormationAPI.DescribeStacks(in)
+}
+func (o observedCloudFormation) DescribeStacksWithContext(ctx aws.Context, in *cloudformation.DescribeStacksInput, opts ...request.Option) (out *cloudformation.DescribeStacksOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DescribeStacks", start, err) }(time.Now())
+	return o.CloudFormationAPI.DescribeStacksWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) ExecuteChangeSetWithContext(ctx aws.Context, in *cloudformation.ExecuteChangeSetInput, opts ...request.Option) (out *cloudformation.ExecuteChangeSetOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "ExecuteChangeSet", start, err) }(time.Now())
+	return o.CloudFormationAPI.ExecuteChangeSetWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) GetTemplate(in *cloudformation.GetTemplateInput) (out *cloudformation.GetTemplateOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "GetTemplate", start, err) }(time.Now())
+	return o.CloudFormationAPI.GetTemplate(in)
+}
+func (o observedCloudFormation) GetTemplateSummary(in *cloudformation.GetTemplateSummaryInput) (out *cloudformation.GetTemplateSummaryOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "GetTemplateSummary", start, err) }(time.Now())
+	return o.CloudFormationAPI.GetTemplateSummary(in)
+}
+func (o observedCloudFormation) GetTemplateSummaryWithContext(ctx aws.Context, in *cloudformation.GetTemplateSummaryInput, opts ...request.Option) (out *cloudformation.GetTemplateSummaryOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "GetTemplateSummary", start, err) }(time.Now())
+	return o.CloudFormationAPI.GetTemplateSummaryWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) ListChangeSets(in *cloudformation.ListChangeSetsInput) (out *cloudformation.ListChangeSetsOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "ListChangeSets", start, err) }(time.Now())
+	return o.CloudFormationAPI.ListChangeSets(in)
+}
+func (o observedCloudFormation) ListStackResources(in *cloudformation.ListStackResourcesInput) (out *cloudformation.ListStackResourcesOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "ListStackResources", start, err) }(time.Now())
+	return o.CloudFormationAPI.ListStackResources(in)
+}
+func (o observedCloudFormation) UpdateTerminationProtection(in *cloudformation.UpdateTerminationProtectionInput) (out *cloudformation.UpdateTerminationProtectionOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "UpdateTerminationProtection", start, err) }(time.Now())
+	return o.CloudFormationAPI.UpdateTerminationProtection(in)
+}
+func (o observedCloudFormation) ValidateTemplateWithContext(ctx aws.Context, in *cloudformation.ValidateTemplateInput, opts ...request.Option) (out *cloudformation.ValidateTemplateOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "ValidateTemplate", start, err) }(time.Now())
+	return o.CloudFormationAPI.ValidateTemplateWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) WaitUntilChangeSetCreateCompleteWithContext(ctx aws.Context, in *cloudformation.DescribeChangeSetInput, opts ...request.WaiterOption) (err error) {
+	defer func(start time.Time) { observe(o.hook, "WaitUntilChangeSetCreateComplete", start, err) }(time.Now())
+	return o.CloudFormationAPI.WaitUntilChangeSetCreateCompleteWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) WaitUntilStackCreateCompleteWithContext(ctx aws.Context, in *cloudformation.DescribeStacksInput, opts ...request.WaiterOption) (err error) {
+	defer func(start time.Time) { observe(o.hook, "WaitUntilStackCreateComplete", start, err) }(time.Now())
+	return o.CloudFormationAPI.WaitUntilStackCreateCompleteWithContext(ctx, in, opts...)
+}
+func (o observedCloudFormation) WaitUntilStackDeleteComplete(in *cloudformation.DescribeStacksInput) (err error) {
+	defer func(start time.Time) { observe(o.hook, "WaitUntilStackDeleteComplete", start, err) }(time.Now())
+	return o.CloudFormationAPI.WaitUntilStackDeleteComplete(in)
+}
+func (o observedCloudFormation) WaitUntilStackUpdateCompleteWithContext(ctx aws.Context, in *cloudformation.DescribeStacksInput, opts ...request.WaiterOption) (err error) {
+	defer func(start time.Time) { observe(o.hook, "WaitUntilStackUpdateComplete", start, err) }(time.Now())
+	return o.CloudFormationAPI.WaitUntilStackUpdateCompleteWithContext(ctx, in, opts...)
+}
+
+// observedS3 reports the calls used by Bucket, and by the s3manager uploader and downloader, to a MetricsHook.
+type observedS3 struct {
+	s3iface.S3API
+	hook MetricsHook
+}
+
+func (o observedS3) AbortMultipartUpload(in *s3.AbortMultipartUploadInput) (out *s3.AbortMultipartUploadOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "AbortMultipartUpload", start, err) }(time.Now())
+	return o.S3API.AbortMultipartUpload(in)
+}
+func (o observedS3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, opts ...request.Option) (out *s3.AbortMultipartUploadOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "AbortMultipartUpload", start, err) }(time.Now())
+	return o.S3API.AbortMultipartUploadWithContext(ctx, in, opts...)
+}
+func (o observedS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (out *s3.CompleteMultipartUploadOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "CompleteMultipartUpload", start, err) }(time.Now())
+	return o.S3API.CompleteMultipartUploadWithContext(ctx, in, opts...)
+}
+func (o observedS3) CopyObject(in *s3.CopyObjectInput) (out *s3.CopyObjectOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "CopyObject", start, err) }(time.Now())
+	return o.S3API.CopyObject(in)
+}
+func (o observedS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (out *s3.CreateMultipartUploadOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "CreateMultipartUpload", start, err) }(time.Now())
+	return o.S3API.CreateMultipartUploadWithContext(ctx, in, opts...)
+}
+func (o observedS3) DeleteObject(in *s3.DeleteObjectInput) (out *s3.DeleteObjectOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DeleteObject", start, err) }(time.Now())
+	return o.S3API.DeleteObject(in)
+}
+func (o observedS3) DeleteObjects(in *s3.DeleteObjectsInput) (out *s3.DeleteObjectsOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "DeleteObjects", start, err) }(time.Now())
+	return o.S3API.DeleteObjects(in)
+}
+func (o observedS3) GetBucketOwnershipControls(in *s3.GetBucketOwnershipControlsInput) (out *s3.GetBucketOwnershipControlsOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "GetBucketOwnershipControls", start, err) }(time.Now())
+	return o.S3API.GetBucketOwnershipControls(in)
+}
+func (o observedS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (out *s3.GetObjectOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "GetObject", start, err) }(time.Now())
+	return o.S3API.GetObjectWithContext(ctx, in, opts...)
+}
+func (o observedS3) HeadObject(in *s3.HeadObjectInput) (out *s3.HeadObjectOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "HeadObject", start, err) }(time.Now())
+	return o.S3API.HeadObject(in)
+}
+func (o observedS3) ListMultipartUploads(in *s3.ListMultipartUploadsInput) (out *s3.ListMultipartUploadsOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "ListMultipartUploads", start, err) }(time.Now())
+	return o.S3API.ListMultipartUploads(in)
+}
+func (o observedS3) ListObjectsV2(in *s3.ListObjectsV2Input) (out *s3.ListObjectsV2Output, err error) {
+	defer func(start time.Time) { observe(o.hook, "ListObjectsV2", start, err) }(time.Now())
+	return o.S3API.ListObjectsV2(in)
+}
+func (o observedS3) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, opts ...request.Option) (out *s3.ListObjectsV2Output, err error) {
+	defer func(start time.Time) { observe(o.hook, "ListObjectsV2", start, err) }(time.Now())
+	return o.S3API.ListObjectsV2WithContext(ctx, in, opts...)
+}
+func (o observedS3) PutObject(in *s3.PutObjectInput) (out *s3.PutObjectOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "PutObject", start, err) }(time.Now())
+	return o.S3API.PutObject(in)
+}
+func (o observedS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (out *s3.PutObjectOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "PutObject", start, err) }(time.Now())
+	return o.S3API.PutObjectWithContext(ctx, in, opts...)
+}
+func (o observedS3) SelectObjectContent(in *s3.SelectObjectContentInput) (out *s3.SelectObjectContentOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "SelectObjectContent", start, err) }(time.Now())
+	return o.S3API.SelectObjectContent(in)
+}
+func (o observedS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (out *s3.UploadPartOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "UploadPart", start, err) }(time.Now())
+	return o.S3API.UploadPartWithContext(ctx, in, opts...)
+}
+
+// observedUploader reports the uploads of a custom uploader to a MetricsHook, the default uploader is
+// already observed through observedS3.
+type observedUploader struct {
+	s3manageriface.UploaderAPI
+	hook MetricsHook
+}
+
+func (o observedUploader) Upload(in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (out *s3manager.UploadOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "Upload", start, err) }(time.Now())
+	return o.UploaderAPI.Upload(in, opts...)
+}
+func (o observedUploader) UploadWithContext(ctx aws.Context, in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (out *s3manager.UploadOutput, err error) {
+	defer func(start time.Time) { observe(o.hook, "Upload", start, err) }(time.Now())
+	return o.UploaderAPI.UploadWithContext(ctx, in, opts...)
+}
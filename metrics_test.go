@@ -0,0 +1,131 @@
+package awsutils
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+type recordingHook struct {
+	mu  sync.Mutex
+	ops []string
+}
+
+func (h *recordingHook) Observe(op string, d time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		op += " " + err.Error()
+	}
+	h.ops = append(h.ops, op)
+}
+
+func TestStackMetricsHook(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	hook := &recordingHook{}
+	s := NewStack(mock, "name", "url", []string{})
+	s.MetricsHook = hook
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := "ValidateTemplate,DescribeStacks ValidationError: Stack with id name does not exist,CreateStack,WaitUntilStackCreateComplete"
+	if strings.Join(hook.ops, ",") != expected {
+		t.Errorf("Expected %s, and got %v", expected, hook.ops)
+	}
+}
+
+func TestBucketMetricsHook(t *testing.T) {
+	mock := &mockedS3Client{CopyErr: errors.New("AccessDenied")}
+	hook := &recordingHook{}
+	b := NewBucket(mock, "Bucket", "temp")
+	b.MetricsHook = hook
+	b.MoveObject("src", "dest")
+	if strings.Join(hook.ops, ",") != "CopyObject AccessDenied" {
+		t.Errorf("Expected the failed copy, and got %v", hook.ops)
+	}
+}
+
+func TestBucketMetricsHookUploader(t *testing.T) {
+	hook := &recordingHook{}
+	b := NewBucket(&mockedS3Client{}, "Bucket", "temp")
+	b.uploader = &mockedUploader{}
+	b.MetricsHook = hook
+	if err := b.UploadReader("key", bytes.NewReader([]byte("content"))); err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(hook.ops, ",") != "Upload" {
+		t.Errorf("Expected the upload of the custom uploader, and got %v", hook.ops)
+	}
+}
+
+// TestObservedClientsCoverCalls checks that every AWS call made through client() or newUploader() is
+// reported, a method missing from the observed wrappers would silently reach the embedded client.
+func TestObservedClientsCoverCalls(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	observed := map[string]map[string]bool{}
+	type call struct{ getter, method, pos string }
+	calls := make([]call, 0)
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if n.Recv == nil || len(n.Recv.List) != 1 {
+					return true
+				}
+				if recv, ok := n.Recv.List[0].Type.(*ast.Ident); ok && strings.HasPrefix(recv.Name, "observed") {
+					if observed[recv.Name] == nil {
+						observed[recv.Name] = map[string]bool{}
+					}
+					observed[recv.Name][n.Name.Name] = true
+				}
+			case *ast.SelectorExpr:
+				getter, ok := n.X.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				if sel, ok := getter.Fun.(*ast.SelectorExpr); ok && (sel.Sel.Name == "client" || sel.Sel.Name == "newUploader") {
+					calls = append(calls, call{sel.Sel.Name, n.Sel.Name, fset.Position(n.Pos()).String()})
+				}
+			}
+			return true
+		})
+	}
+
+	cfnAPI := reflect.TypeOf((*cloudformationiface.CloudFormationAPI)(nil)).Elem()
+	for _, c := range calls {
+		wrapper := "observedS3"
+		if c.getter == "newUploader" {
+			wrapper = "observedUploader"
+		} else if _, ok := cfnAPI.MethodByName(c.method); ok {
+			wrapper = "observedCloudFormation"
+		}
+		if !observed[wrapper][c.method] {
+			t.Errorf("%s: %s is not reported by %s", c.pos, c.method, wrapper)
+		}
+	}
+	if len(calls) == 0 {
+		t.Errorf("Expected calls through client()")
+	}
+}
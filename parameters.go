@@ -0,0 +1,89 @@
+package awsutils
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const redactedValue = "****"
+
+//RedactParameters ... returns a copy of parameters with the values of the secret keys replaced by ****,
+//secret keys are matched ignoring case and may contain wildcards (e.g. *PASSWORD*)
+func RedactParameters(parameters map[string]string, secretKeys []string) map[string]string {
+	redacted := make(map[string]string)
+	for key, value := range parameters {
+		if isSecretKey(key, secretKeys) {
+			value = redactedValue
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+func isSecretKey(key string, secretKeys []string) bool {
+	key = strings.ToUpper(key)
+	for _, pattern := range secretKeys {
+		if matched, err := path.Match(strings.ToUpper(pattern), key); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+//RemapKeys ... renames the keys of m according to mapping (old name -> new name), keys without a mapping
+//are kept when keepUnmapped is true and dropped otherwise. Useful to feed ReadOutputs into CreateOrUpdate.
+func RemapKeys(m map[string]string, mapping map[string]string, keepUnmapped bool) map[string]string {
+	result := make(map[string]string)
+	for key, value := range m {
+		if newKey, ok := mapping[key]; ok {
+			result[newKey] = value
+		} else if keepUnmapped {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+//ValidateParameterPatterns ... checks the value of each parameter named in patterns against its regular
+//expression, a missing parameter is checked as an empty value
+func ValidateParameterPatterns(parameters map[string]string, patterns map[string]string) error {
+	keys := make([]string, 0, len(patterns))
+	for key := range patterns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	violations := make([]string, 0)
+	for _, key := range keys {
+		re, err := regexp.Compile(patterns[key])
+		if err != nil {
+			return fmt.Errorf("Invalid pattern for %s: %s", key, err)
+		}
+		if !re.MatchString(parameters[key]) {
+			violations = append(violations, fmt.Sprintf("%s: %q does not match %s", key, parameters[key], patterns[key]))
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid: [%s]", strings.Join(violations, ","))
+}
+
+// diffParameters returns the keys whose value differs between current and desired with [current, desired]
+// values, a key missing on one side has an empty value there.
+func diffParameters(current, desired map[string]string) map[string][2]string {
+	diff := make(map[string][2]string)
+	for key, value := range desired {
+		if old, ok := current[key]; !ok || old != value {
+			diff[key] = [2]string{old, value}
+		}
+	}
+	for key, old := range current {
+		if _, ok := desired[key]; !ok {
+			diff[key] = [2]string{old, ""}
+		}
+	}
+	return diff
+}
@@ -0,0 +1,83 @@
+package awsutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactParametersExact(t *testing.T) {
+	parameters := map[string]string{"ApiKey": "abc", "Env": "dev"}
+	redacted := RedactParameters(parameters, []string{"ApiKey"})
+	if redacted["ApiKey"] != "****" || redacted["Env"] != "dev" {
+		t.Errorf("Unexpected redacted parameters: %v", redacted)
+	}
+	if parameters["ApiKey"] != "abc" {
+		t.Errorf("The input parameters should not be modified")
+	}
+}
+
+func TestRedactParametersWildcard(t *testing.T) {
+	parameters := map[string]string{
+		"DbPassword":       "secret1",
+		"PASSWORD_ADMIN":   "secret2",
+		"AdminUser":        "admin",
+		"ServiceApiSecret": "secret3",
+	}
+	redacted := RedactParameters(parameters, []string{"*PASSWORD*", "*Secret"})
+	expected := map[string]string{
+		"DbPassword":       "****",
+		"PASSWORD_ADMIN":   "****",
+		"AdminUser":        "admin",
+		"ServiceApiSecret": "****",
+	}
+	for key, value := range expected {
+		if redacted[key] != value {
+			t.Errorf("Expected %s to be %s, and got %s", key, value, redacted[key])
+		}
+	}
+}
+
+func TestRemapKeys(t *testing.T) {
+	outputs := map[string]string{"BucketName": "my-bucket", "QueueUrl": "https://queue", "Other": "x"}
+	mapping := map[string]string{"BucketName": "SourceBucket", "QueueUrl": "Queue"}
+
+	// Rename and drop
+	remapped := RemapKeys(outputs, mapping, false)
+	if len(remapped) != 2 || remapped["SourceBucket"] != "my-bucket" || remapped["Queue"] != "https://queue" {
+		t.Errorf("Unexpected remapped keys: %v", remapped)
+	}
+
+	// Rename and keep
+	remapped = RemapKeys(outputs, mapping, true)
+	if len(remapped) != 3 || remapped["SourceBucket"] != "my-bucket" || remapped["Other"] != "x" {
+		t.Errorf("Unexpected remapped keys: %v", remapped)
+	}
+	if _, ok := remapped["BucketName"]; ok {
+		t.Errorf("Renamed keys should not keep their old name")
+	}
+}
+
+func TestValidateParameterPatterns(t *testing.T) {
+	patterns := map[string]string{"Env": "^(dev|staging|prod)$", "Port": `^\d+$`}
+	err := ValidateParameterPatterns(map[string]string{"Env": "prod", "Port": "8080", "Other": "x"}, patterns)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	err = ValidateParameterPatterns(map[string]string{"Env": "test", "Port": "80a"}, patterns)
+	expected := `Invalid: [Env: "test" does not match ^(dev|staging|prod)$,Port: "80a" does not match ^\d+$]`
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error :%s, and got %v", expected, err)
+	}
+
+	// Missing parameters are checked as empty
+	err = ValidateParameterPatterns(map[string]string{"Port": "1"}, patterns)
+	if err == nil || !strings.Contains(err.Error(), `Env: ""`) {
+		t.Errorf("Expected a violation for the missing Env, and got %v", err)
+	}
+
+	err = ValidateParameterPatterns(map[string]string{}, map[string]string{"Env": "("})
+	if err == nil || !strings.Contains(err.Error(), "Invalid pattern for Env") {
+		t.Errorf("Expected invalid pattern error, and got %v", err)
+	}
+}
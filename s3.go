@@ -2,57 +2,206 @@
 package awsutils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
 const (
 	messageClientNotDefined = "Aws Client not defined"
+	messageNoFilesToUpload  = "No files to upload"
+)
+
+//ErrBucketNotFound ... returned when the bucket does not exist
+var ErrBucketNotFound = errors.New("Bucket not found")
+
+// OverwritePolicy controls what DownloadBucket does when a local file already exists.
+type OverwritePolicy int
+
+const (
+	// Overwrite replaces existing local files.
+	Overwrite OverwritePolicy = iota
+	// Skip keeps existing local files and does not download them.
+	Skip
+	// Fail aborts the download before transferring anything.
+	Fail
 )
 
 type Bucket struct {
+	// bytesTransferred is first to keep it 64-bit aligned for atomic access.
+	bytesTransferred int64
+
 	s3Client s3iface.S3API
+	uploader s3manageriface.UploaderAPI
 	Name     string
 	LocalDir string
+	// MetricsHook observes every S3 call of the bucket when set.
+	MetricsHook MetricsHook
+	// KeyPrefix is prepended, joined with a "/", to the keys of the files uploaded by UploadBucket.
+	KeyPrefix string
+	// DryRun makes UploadBucket only check that the bucket can be written to, nothing is uploaded.
+	DryRun bool
+	// AbortUploadsOlderThan makes UploadBucket first abort the incomplete multipart uploads
+	// initiated before that long ago, zero leaves them alone.
+	AbortUploadsOlderThan time.Duration
+	// FollowSymlinks makes UploadBucket upload the files symlinks point to, by default symlinks are skipped.
+	// Symlinked directories are never walked.
+	FollowSymlinks bool
+	// AllowEmpty makes UploadBucket succeed when there is nothing to upload.
+	AllowEmpty bool
+	// StartAfter makes DownloadBucket list (and download) only the keys after it.
+	StartAfter string
+	// Timeout bounds the whole DownloadBucket operation, zero means no limit.
+	Timeout time.Duration
+	// OverwritePolicy applies to local files that already exist, defaults to Overwrite.
+	OverwritePolicy OverwritePolicy
+	// DownloadPartSize is the size of each ranged GET used to download an object. Zero uses
+	// s3manager.DefaultDownloadPartSize (5MB); there is no minimum for downloads but every part is a request.
+	DownloadPartSize int64
+	// DownloadConcurrency is the number of parts of an object fetched in parallel, zero uses
+	// s3manager.DefaultDownloadConcurrency.
+	DownloadConcurrency int
+	// DecompressGzip makes the downloads decompress the objects whose key ends in ".gz" or stored with
+	// Content-Encoding gzip, the ".gz" is removed from the local file name. Objects are then streamed
+	// with a single GET instead of being fetched in parts. Keys that would share a local file, such as
+	// x.gz and x, fail the download.
+	DecompressGzip bool
+
+	// StateFile records the keys downloaded by DownloadBucket and DownloadKeys so a later run
+	// skips them, which allows resuming an interrupted download. Empty disables it.
+	StateFile string
+
+	// CheckDiskSpace makes DownloadBucket fail before downloading anything when the objects to download,
+	// plus DiskSpaceHeadroom bytes, do not fit in the free space of LocalDir. The stored sizes are
+	// counted, so with DecompressGzip the headroom must also cover what the objects grow when decompressed.
+	CheckDiskSpace    bool
+	DiskSpaceHeadroom uint64
+
+	// UseAccelerate makes InitializeS3 use the S3 Transfer Acceleration endpoint,
+	// the bucket must have transfer acceleration enabled.
+	UseAccelerate bool
+
+	// CacheControl and Expires set the headers of uploaded objects, CacheControlByExtension
+	// overrides CacheControl for keys with the given extension (e.g. ".html").
+	CacheControl            string
+	CacheControlByExtension map[string]string
+	Expires                 *time.Time
+
+	// DetectContentType sets the Content-Type of uploaded files from their extension or, when the
+	// extension is unknown, by sniffing their first 512 bytes.
+	DetectContentType bool
+	// ACL is the canned ACL (e.g. "public-read") of uploaded objects. It is ignored when the bucket
+	// has ACLs disabled by the BucketOwnerEnforced object ownership.
+	ACL string
+	// TaggingFunc returns the tags of each uploaded object from its key, nil means no tagging.
+	TaggingFunc func(key string) map[string]string
+	// ChecksumAlgorithm (CRC32, CRC32C, SHA1 or SHA256) makes UploadBucket and UploadReader compute that
+	// checksum of every object, or of every part of the larger UploadReader bodies, and send it so S3 validates
+	// the integrity of the object. Empty uploads without additional checksum.
+	ChecksumAlgorithm string
+	// KeyFunc derives the key of an uploaded file from its local path and default key (its path relative
+	// to LocalDir), KeyPrefix is still prepended. Nil keeps the default key.
+	KeyFunc func(localPath, defaultKey string) (string, error)
+
+	// Object lock settings applied to every uploaded object (the bucket must have object lock enabled).
+	ObjectLockMode            string
+	ObjectLockRetainUntilDate time.Time
+	ObjectLockLegalHoldStatus string
 }
 
 func NewBucket(client s3iface.S3API, name, localDir string) Bucket {
 	return Bucket{s3Client: client, Name: name, LocalDir: localDir}
 }
 
+// client returns the S3 client, reporting its calls to MetricsHook when set.
+func (b *Bucket) client() s3iface.S3API {
+	if b.MetricsHook == nil {
+		return b.s3Client
+	}
+	return observedS3{b.s3Client, b.MetricsHook}
+}
+
+//InitializeS3 ... creates the S3 client used by the bucket for the given region
+func (b *Bucket) InitializeS3(region string) {
+	sess := session.Must(session.NewSession(b.awsConfig(region)))
+	b.s3Client = s3.New(sess)
+}
+func (b *Bucket) awsConfig(region string) *aws.Config {
+	cfg := &aws.Config{Region: aws.String(region)}
+	if b.UseAccelerate {
+		cfg.S3UseAccelerate = aws.Bool(true)
+	}
+	return cfg
+}
+
 //DownloadBucket ...
 func (b *Bucket) DownloadBucket(excludePatten *string) error {
-	var wg sync.WaitGroup
-
 	if b.s3Client == nil {
 		return fmt.Errorf(messageClientNotDefined)
 	}
+	_, err := b.download(excludePatten)
+	return err
+}
 
+// download fetches the bucket content and returns the objects that were saved locally.
+func (b *Bucket) download(excludePatten *string) ([]*s3.Object, error) {
 	//create local directory
 	if err := os.MkdirAll(b.LocalDir, os.ModePerm); err != nil {
-		return err
+		return nil, err
 	}
 
+	ctx, cancel := b.downloadContext()
+	defer cancel()
+
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(b.Name),
 	}
+	if b.StartAfter != "" {
+		input.StartAfter = aws.String(b.StartAfter)
+	}
 
-	result, err := b.s3Client.ListObjectsV2(input)
+	result, err := b.client().ListObjectsV2WithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil, fmt.Errorf("%w: %s", ErrBucketNotFound, b.Name)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	objects := make([]*s3.Object, 0)
 	for _, s3Obj := range result.Contents {
 		if excludePatten != nil {
 			matched, err := regexp.Match(*excludePatten, []byte(*s3Obj.Key))
@@ -60,46 +209,393 @@ func (b *Bucket) DownloadBucket(excludePatten *string) error {
 				continue
 			}
 		}
+		if skip, err := b.skipExisting(*s3Obj.Key); err != nil {
+			return nil, err
+		} else if skip {
+			continue
+		}
+		objects = append(objects, s3Obj)
+	}
+	if b.CheckDiskSpace {
+		if err := b.checkDiskSpace(objects); err != nil {
+			return nil, err
+		}
+	}
+	return b.fetch(ctx, objects)
+}
 
-		wg.Add(1)
-		go getFromS3(b.Name, b.LocalDir, *s3Obj.Key, b.s3Client, &wg)
+// availableDiskSpace returns the bytes available to the user in the file system of dir.
+var availableDiskSpace = statAvailableDiskSpace
+
+// checkDiskSpace compares the stored size of the objects with the free space of LocalDir, the size of
+// a decompressed object is only known once it is downloaded.
+func (b *Bucket) checkDiskSpace(objects []*s3.Object) error {
+	var total uint64
+	for _, s3Obj := range objects {
+		total += uint64(aws.Int64Value(s3Obj.Size))
+	}
+	available, err := availableDiskSpace(b.LocalDir)
+	if err != nil {
+		return err
+	}
+	if needed := total + b.DiskSpaceHeadroom; needed > available {
+		return fmt.Errorf("Not enough disk space in %s: %d bytes needed, %d available", b.LocalDir, needed, available)
 	}
-	wg.Wait()
 	return nil
 }
-func getFromS3(bucket, baseDir, key string, s3Client s3iface.S3API, wg *sync.WaitGroup) {
-	defer wg.Done()
 
+// loadState reads the keys recorded in StateFile, a missing file means nothing was downloaded yet.
+func (b *Bucket) loadState() (map[string]bool, error) {
+	completed := make(map[string]bool)
+	if b.StateFile == "" {
+		return completed, nil
+	}
+	content, err := ioutil.ReadFile(b.StateFile)
+	if os.IsNotExist(err) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := strings.Split(string(content), "\n")
+	// the last line of an interrupted append is not a whole key
+	for _, key := range keys[:len(keys)-1] {
+		if key != "" {
+			completed[key] = true
+		}
+	}
+	return completed, nil
+}
+
+// openState compacts StateFile to the completed keys, one per line, and opens it for fetch to append
+// the keys it downloads. The compacted file is written next to StateFile and renamed so an interrupted
+// write never leaves a truncated state.
+func (b *Bucket) openState(completed map[string]bool) (*os.File, error) {
+	keys := make([]string, 0, len(completed))
+	for key := range completed {
+		keys = append(keys, key+"\n")
+	}
+	sort.Strings(keys)
+	tmp := b.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(keys, "")), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, b.StateFile); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(b.StateFile, os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+//DownloadKeys ... downloads exactly the given keys, without listing the bucket
+func (b *Bucket) DownloadKeys(keys []string) error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	if err := os.MkdirAll(b.LocalDir, os.ModePerm); err != nil {
+		return err
+	}
+	ctx, cancel := b.downloadContext()
+	defer cancel()
+
+	objects := make([]*s3.Object, 0, len(keys))
+	for _, key := range keys {
+		if skip, err := b.skipExisting(key); err != nil {
+			return err
+		} else if skip {
+			continue
+		}
+		objects = append(objects, &s3.Object{Key: aws.String(key)})
+	}
+	_, err := b.fetch(ctx, objects)
+	return err
+}
+
+// downloadContext bounds a download by Timeout.
+func (b *Bucket) downloadContext() (context.Context, context.CancelFunc) {
+	if b.Timeout > 0 {
+		return context.WithTimeout(context.Background(), b.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// localPath is the file key is downloaded to, without the ".gz" when DecompressGzip is set.
+func (b *Bucket) localPath(key string) string {
+	fileName := path.Join(b.LocalDir, key)
+	if b.DecompressGzip {
+		fileName = strings.TrimSuffix(fileName, ".gz")
+	}
+	return fileName
+}
+
+// checkLocalPaths fails when two keys are downloaded to the same file, which happens to x.gz and x
+// when DecompressGzip is set.
+func (b *Bucket) checkLocalPaths(objects []*s3.Object) error {
+	keys := make(map[string]string, len(objects))
+	for _, s3Obj := range objects {
+		fileName := b.localPath(*s3Obj.Key)
+		if other, ok := keys[fileName]; ok && other != *s3Obj.Key {
+			return fmt.Errorf("Keys %s and %s are both downloaded to %s", other, *s3Obj.Key, fileName)
+		}
+		keys[fileName] = *s3Obj.Key
+	}
+	return nil
+}
+
+// skipExisting applies the OverwritePolicy to the local file of key.
+func (b *Bucket) skipExisting(key string) (bool, error) {
+	fileName := b.localPath(key)
+	if b.OverwritePolicy == Overwrite || !fileExists(fileName) {
+		return false, nil
+	}
+	if b.OverwritePolicy == Fail {
+		return false, fmt.Errorf("Local file already exists: %s", fileName)
+	}
+	return true, nil
+}
+
+// fetch downloads the objects concurrently and returns the ones that were saved locally.
+func (b *Bucket) fetch(ctx context.Context, objects []*s3.Object) ([]*s3.Object, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	completed, err := b.loadState()
+	if err != nil {
+		return nil, err
+	}
+	var state *os.File
+	if b.StateFile != "" {
+		if state, err = b.openState(completed); err != nil {
+			return nil, err
+		}
+		defer state.Close()
+	}
+
+	if err := b.checkLocalPaths(objects); err != nil {
+		return nil, err
+	}
+
+	downloaded := make([]*s3.Object, 0)
+	for _, s3Obj := range objects {
+		if completed[*s3Obj.Key] {
+			continue
+		}
+		wg.Add(1)
+		go func(s3Obj *s3.Object) {
+			defer wg.Done()
+			if err := b.getFromS3(ctx, *s3Obj.Key); err != nil {
+				log.Println(err.Error())
+				return
+			}
+			mu.Lock()
+			downloaded = append(downloaded, s3Obj)
+			if state != nil {
+				if _, err := io.WriteString(state, *s3Obj.Key+"\n"); err != nil {
+					log.Println("Unable to save download state: " + err.Error())
+				}
+			}
+			mu.Unlock()
+		}(s3Obj)
+	}
+	wg.Wait()
+	return downloaded, ctx.Err()
+}
+func (b *Bucket) getFromS3(ctx context.Context, key string) error {
+	baseDir := b.LocalDir
 	if err := mkDirIfNeeded(baseDir, key); err != nil {
-		log.Println("Unable to create dir: " + err.Error())
-		return
+		return errors.New("Unable to create dir: " + err.Error())
+	}
+	if b.DecompressGzip {
+		return b.getDecompressedFromS3(ctx, key)
 	}
 
-	fileName := path.Join(baseDir, key)
+	fileName := b.localPath(key)
 	file, err := os.Create(fileName)
 
 	if err != nil {
-		log.Println("Unable to create file: " + err.Error())
-		return
+		return errors.New("Unable to create file: " + err.Error())
 	}
 	defer file.Close()
 
 	input := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
+		Bucket: aws.String(b.Name),
 		Key:    aws.String(key),
 	}
 
-	results, err := s3Client.GetObject(input)
+	n, err := b.newDownloader().DownloadWithContext(ctx, file, input)
 	if err != nil {
-		log.Println("Unable to download item: " + err.Error())
-		return
+		return errors.New("Unable to download item: " + err.Error())
 	}
-	defer results.Body.Close()
+	atomic.AddInt64(&b.bytesTransferred, n)
+	return nil
+}
 
-	if _, err := io.Copy(file, results.Body); err != nil {
-		log.Println("Unable to copy item: " + err.Error())
-		return
+// getDecompressedFromS3 streams the object to its local file, through gzip when it is compressed.
+func (b *Bucket) getDecompressedFromS3(ctx context.Context, key string) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(key),
+	}
+	// keep the HTTP client from decompressing Content-Encoding gzip objects on its own
+	identity := request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"})
+	resp, err := b.client().GetObjectWithContext(ctx, input, identity)
+	if err != nil {
+		return errors.New("Unable to download item: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(key, ".gz") || aws.StringValue(resp.ContentEncoding) == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return errors.New("Unable to decompress item: " + err.Error())
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// the object is written next to its local file and renamed, a failed download leaves no truncated file
+	fileName := b.localPath(key)
+	file, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return errors.New("Unable to create file: " + err.Error())
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return errors.New("Unable to download item: " + err.Error())
+	}
+	if err := file.Close(); err != nil {
+		return errors.New("Unable to create file: " + err.Error())
 	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return errors.New("Unable to create file: " + err.Error())
+	}
+	if err := os.Rename(file.Name(), fileName); err != nil {
+		return errors.New("Unable to create file: " + err.Error())
+	}
+	atomic.AddInt64(&b.bytesTransferred, aws.Int64Value(resp.ContentLength))
+	return nil
+}
+
+// ManifestEntry describes a downloaded object.
+type ManifestEntry struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+	StorageClass string    `json:"storageClass"`
+	LocalPath    string    `json:"localPath"`
+}
+
+//DownloadWithManifest ... downloads the bucket and writes a JSON manifest of the downloaded objects
+func (b *Bucket) DownloadWithManifest(manifestPath string) error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	downloaded, err := b.download(nil)
+	if err != nil {
+		return err
+	}
+	sort.Slice(downloaded, func(i, j int) bool { return *downloaded[i].Key < *downloaded[j].Key })
+
+	manifest := make([]ManifestEntry, 0, len(downloaded))
+	for _, s3Obj := range downloaded {
+		manifest = append(manifest, ManifestEntry{
+			Key:          aws.StringValue(s3Obj.Key),
+			Size:         aws.Int64Value(s3Obj.Size),
+			ETag:         aws.StringValue(s3Obj.ETag),
+			LastModified: aws.TimeValue(s3Obj.LastModified),
+			StorageClass: aws.StringValue(s3Obj.StorageClass),
+			LocalPath:    b.localPath(*s3Obj.Key),
+		})
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, content, 0644)
+}
+func (b *Bucket) newDownloader() *s3manager.Downloader {
+	return s3manager.NewDownloaderWithClient(b.client(), func(d *s3manager.Downloader) {
+		if b.DownloadPartSize > 0 {
+			d.PartSize = b.DownloadPartSize
+		}
+		if b.DownloadConcurrency > 0 {
+			d.Concurrency = b.DownloadConcurrency
+		}
+	})
+}
+
+//Select ... runs an S3 Select SQL expression on the object and returns the records it produces
+func (b *Bucket) Select(key, expression string, inputSerialization *s3.InputSerialization, outputSerialization *s3.OutputSerialization) ([]byte, error) {
+	if b.s3Client == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	resp, err := b.client().SelectObjectContent(&s3.SelectObjectContentInput{
+		Bucket:              aws.String(b.Name),
+		Key:                 aws.String(key),
+		Expression:          aws.String(expression),
+		ExpressionType:      aws.String(s3.ExpressionTypeSql),
+		InputSerialization:  inputSerialization,
+		OutputSerialization: outputSerialization,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream := resp.EventStream
+	defer stream.Close()
+
+	var records bytes.Buffer
+	ended := false
+	for event := range stream.Events() {
+		switch e := event.(type) {
+		case *s3.RecordsEvent:
+			records.Write(e.Payload)
+		case *s3.EndEvent:
+			ended = true
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	// without an EndEvent the results are incomplete
+	if !ended {
+		return nil, fmt.Errorf("Select on %s ended before the end of the results", key)
+	}
+	return records.Bytes(), nil
+}
+
+//BytesTransferred ... returns the number of bytes downloaded so far, it is safe to call during a download
+func (b *Bucket) BytesTransferred() int64 {
+	return atomic.LoadInt64(&b.bytesTransferred)
+}
+
+//CountObjects ... returns the number of objects under prefix, only the listing is paged through
+func (b *Bucket) CountObjects(prefix string) (int64, error) {
+	if b.s3Client == nil {
+		return 0, fmt.Errorf(messageClientNotDefined)
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(b.Name),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1000),
+	}
+	var count int64
+	for {
+		resp, err := b.client().ListObjectsV2(input)
+		if err != nil {
+			return 0, err
+		}
+		count += aws.Int64Value(resp.KeyCount)
+		if !aws.BoolValue(resp.IsTruncated) {
+			return count, nil
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+}
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
 }
 func mkDirIfNeeded(baseDir string, key string) (err error) {
 	err = nil
@@ -121,17 +617,153 @@ func (b *Bucket) UploadBucket() error {
 		return fmt.Errorf(messageClientNotDefined)
 	}
 
-	for _, file := range getFiles(b.LocalDir) {
+	files, err := getFiles(b.LocalDir, b.FollowSymlinks)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		if b.AllowEmpty {
+			log.Println(messageNoFilesToUpload)
+			return nil
+		}
+		return fmt.Errorf(messageNoFilesToUpload)
+	}
+	if b.DryRun {
+		return b.CheckWriteAccess()
+	}
+	if b.AbortUploadsOlderThan > 0 {
+		if _, err := b.AbortStaleMultipartUploads(b.AbortUploadsOlderThan); err != nil {
+			return err
+		}
+	}
+	useACL, err := b.checkACL()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
 		wg.Add(1)
-		go putToS3(b.Name, b.LocalDir, file, b.s3Client, &wg)
+		go b.putToS3(file, useACL, &wg)
 	}
 	wg.Wait()
 	return nil
 }
-func putToS3(bucket, baseDir, fileName string, s3Client s3iface.S3API, wg *sync.WaitGroup) {
+
+//ListMultipartUploads ... lists the multipart uploads of the bucket that were initiated but not completed or aborted
+func (b *Bucket) ListMultipartUploads() ([]*s3.MultipartUpload, error) {
+	if b.s3Client == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	uploads := make([]*s3.MultipartUpload, 0)
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(b.Name)}
+	for {
+		resp, err := b.client().ListMultipartUploads(input)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, resp.Uploads...)
+		if !aws.BoolValue(resp.IsTruncated) {
+			return uploads, nil
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.UploadIdMarker = resp.NextUploadIdMarker
+	}
+}
+
+//AbortMultipartUpload ... aborts an incomplete multipart upload, freeing the storage of its parts
+func (b *Bucket) AbortMultipartUpload(key, uploadID string) error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	_, err := b.client().AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.Name),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
+
+//AbortStaleMultipartUploads ... aborts the incomplete multipart uploads initiated more than olderThan ago
+//and returns how many were aborted
+func (b *Bucket) AbortStaleMultipartUploads(olderThan time.Duration) (int, error) {
+	uploads, err := b.ListMultipartUploads()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	aborted := 0
+	for _, upload := range uploads {
+		if !aws.TimeValue(upload.Initiated).Before(cutoff) {
+			continue
+		}
+		if err := b.AbortMultipartUpload(aws.StringValue(upload.Key), aws.StringValue(upload.UploadId)); err != nil {
+			return aborted, err
+		}
+		aborted++
+	}
+	return aborted, nil
+}
+
+// checkACL tells if the uploads set ACL, it is ignored when the bucket has ACLs disabled as setting one
+// would fail. When the ownership controls can't be read the ACL is kept.
+func (b *Bucket) checkACL() (bool, error) {
+	if b.ACL == "" {
+		return false, nil
+	}
+	resp, err := b.client().GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{Bucket: aws.String(b.Name)})
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "OwnershipControlsNotFoundError":
+			return true, nil
+		case "AccessDenied":
+			log.Println("Unable to read the ownership controls of bucket " + b.Name + ", keeping ACL " + b.ACL + ": " + aerr.Message())
+			return true, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range resp.OwnershipControls.Rules {
+		if aws.StringValue(rule.ObjectOwnership) == s3.ObjectOwnershipBucketOwnerEnforced {
+			log.Println("ACLs are disabled on bucket " + b.Name + ", ignoring ACL " + b.ACL)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//CheckWriteAccess ... verifies the credentials can write to the bucket by putting and deleting an empty object
+func (b *Bucket) CheckWriteAccess() error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	key := fmt.Sprintf(".awsutils-preflight-%d", time.Now().UnixNano())
+	_, err := b.client().PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(nil),
+	})
+	if err == nil {
+		_, err = b.client().DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(b.Name), Key: aws.String(key)})
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "AccessDenied":
+			return fmt.Errorf("Access denied to bucket %s: %s", b.Name, aerr.Message())
+		case s3.ErrCodeNoSuchBucket:
+			return fmt.Errorf("Bucket %s does not exist", b.Name)
+		}
+	}
+	return err
+}
+func (b *Bucket) putToS3(fileName string, useACL bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	key := toKey(baseDir, fileName)
+	key, err := b.objectKey(fileName)
+	if err != nil {
+		log.Println("Unable to build key: " + err.Error())
+		return
+	}
 	f, err := os.Open(fileName)
 	if err != nil {
 		log.Println("Unable to open file: " + err.Error())
@@ -139,36 +771,444 @@ func putToS3(bucket, baseDir, fileName string, s3Client s3iface.S3API, wg *sync.
 	}
 	defer f.Close()
 
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   aws.ReadSeekCloser(f),
+	input := b.putObjectInput(key, aws.ReadSeekCloser(f), useACL)
+	if err := b.setChecksum(input, f); err != nil {
+		log.Println("Unable to compute checksum: " + err.Error())
+		return
 	}
-	if _, err := s3Client.PutObject(input); err != nil {
+	if _, err := b.client().PutObject(input); err != nil {
 		log.Println("Unable to upload file: " + err.Error())
 		return
 	}
 	return
 
 }
-func getFiles(root string) []string {
+
+// putObjectInput builds the upload of key with the bucket options, the ACL is only set when useACL is true.
+func (b *Bucket) putObjectInput(key string, body io.ReadSeeker, useACL bool) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if b.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(b.ObjectLockMode)
+	}
+	if !b.ObjectLockRetainUntilDate.IsZero() {
+		input.ObjectLockRetainUntilDate = aws.Time(b.ObjectLockRetainUntilDate)
+	}
+	if b.ObjectLockLegalHoldStatus != "" {
+		input.ObjectLockLegalHoldStatus = aws.String(b.ObjectLockLegalHoldStatus)
+	}
+	if cacheControl, ok := b.CacheControlByExtension[path.Ext(key)]; ok {
+		input.CacheControl = aws.String(cacheControl)
+	} else if b.CacheControl != "" {
+		input.CacheControl = aws.String(b.CacheControl)
+	}
+	if b.Expires != nil {
+		input.Expires = b.Expires
+	}
+	if b.ACL != "" && useACL {
+		input.ACL = aws.String(b.ACL)
+	}
+	if b.DetectContentType {
+		if contentType := detectContentType(key, body); contentType != "" {
+			input.ContentType = aws.String(contentType)
+		}
+	}
+	if b.TaggingFunc != nil {
+		if tags := b.TaggingFunc(key); len(tags) > 0 {
+			values := url.Values{}
+			for k, v := range tags {
+				values.Set(k, v)
+			}
+			input.Tagging = aws.String(values.Encode())
+		}
+	}
+	return input
+}
+
+// objectChecksum holds a ChecksumAlgorithm checksum in the field of its algorithm, awsutil.Copy sets it on
+// the inputs with the same fields (PutObjectInput, UploadInput, UploadPartInput, CompletedPart).
+type objectChecksum struct {
+	ChecksumAlgorithm *string
+	ChecksumCRC32     *string
+	ChecksumCRC32C    *string
+	ChecksumSHA1      *string
+	ChecksumSHA256    *string
+}
+
+// setChecksum sets the ChecksumAlgorithm checksum of body, which is then rewound, on the input.
+func (b *Bucket) setChecksum(input interface{}, body io.ReadSeeker) error {
+	if b.ChecksumAlgorithm == "" {
+		return nil
+	}
+	var h hash.Hash
+	switch b.ChecksumAlgorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		h = crc32.NewIEEE()
+	case s3.ChecksumAlgorithmCrc32c:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case s3.ChecksumAlgorithmSha1:
+		h = sha1.New()
+	case s3.ChecksumAlgorithmSha256:
+		h = sha256.New()
+	default:
+		return fmt.Errorf("Invalid ChecksumAlgorithm %s, expected one of [%s]", b.ChecksumAlgorithm, strings.Join(s3.ChecksumAlgorithm_Values(), ","))
+	}
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum := aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	checksum := &objectChecksum{ChecksumAlgorithm: aws.String(b.ChecksumAlgorithm)}
+	switch b.ChecksumAlgorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		checksum.ChecksumCRC32 = sum
+	case s3.ChecksumAlgorithmCrc32c:
+		checksum.ChecksumCRC32C = sum
+	case s3.ChecksumAlgorithmSha1:
+		checksum.ChecksumSHA1 = sum
+	case s3.ChecksumAlgorithmSha256:
+		checksum.ChecksumSHA256 = sum
+	}
+	awsutil.Copy(input, checksum)
+	return nil
+}
+
+// detectContentType returns the type matching the extension of key, or sniffed from the head of body
+// which is then rewound.
+func detectContentType(key string, body io.ReadSeeker) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	if body == nil {
+		return ""
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	if _, seekErr := body.Seek(0, io.SeekStart); seekErr != nil || (err != nil && err != io.EOF && err != io.ErrUnexpectedEOF) {
+		return ""
+	}
+	return http.DetectContentType(head[:n])
+}
+func getFiles(root string, followSymlinks bool) ([]string, error) {
 	var files []string
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !followSymlinks {
+				return nil
+			}
+			// a broken link or a link to a directory is not uploaded
+			if info, err = os.Stat(path); err != nil {
+				log.Println(err)
+				return nil
+			}
+		}
 		if !info.IsDir() {
 			files = append(files, path)
 		}
 		return nil
 	})
-	if err != nil {
-		log.Println(err)
+	return files, err
+}
+func (b *Bucket) objectKey(fileName string) (string, error) {
+	key := toKey(b.LocalDir, fileName)
+	if b.KeyFunc != nil {
+		var err error
+		if key, err = b.KeyFunc(fileName, key); err != nil {
+			return "", err
+		}
 	}
-	return files
+	return withKeyPrefix(b.KeyPrefix, key), nil
 }
 func toKey(baseDir, fileName string) string {
 	dir := filepath.ToSlash(fileName)
 	key := dir[len(baseDir+"/"):]
 	return key
 }
+func withKeyPrefix(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + key
+}
+
+//MoveObject ... copies an object to a new key in the same bucket and then deletes the source
+func (b *Bucket) MoveObject(srcKey, destKey string) error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	copyInput := &s3.CopyObjectInput{
+		Bucket:     aws.String(b.Name),
+		CopySource: aws.String(url.PathEscape(b.Name + "/" + srcKey)),
+		Key:        aws.String(destKey),
+	}
+	if _, err := b.client().CopyObject(copyInput); err != nil {
+		return err
+	}
+	deleteInput := &s3.DeleteObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(srcKey),
+	}
+	_, err := b.client().DeleteObject(deleteInput)
+	return err
+}
+
+//UpdateMetadata ... replaces the user metadata and the Cache-Control of an object by copying it onto itself,
+//the body is not uploaded again. The headers, storage class, encryption, website redirect and object lock
+//settings are kept, so is the Cache-Control when cacheControl is empty. The object ACL is reset to private
+func (b *Bucket) UpdateMetadata(key string, metadata map[string]string, cacheControl string) error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	head, err := b.client().HeadObject(&s3.HeadObjectInput{Bucket: aws.String(b.Name), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(b.Name),
+		CopySource:        aws.String(url.PathEscape(b.Name + "/" + key)),
+		Key:               aws.String(key),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          aws.StringMap(metadata),
+		// the copy resets what is not sent again
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		CacheControl:       head.CacheControl,
+
+		StorageClass:              head.StorageClass,
+		ServerSideEncryption:      head.ServerSideEncryption,
+		SSEKMSKeyId:               head.SSEKMSKeyId,
+		BucketKeyEnabled:          head.BucketKeyEnabled,
+		WebsiteRedirectLocation:   head.WebsiteRedirectLocation,
+		ObjectLockMode:            head.ObjectLockMode,
+		ObjectLockRetainUntilDate: head.ObjectLockRetainUntilDate,
+		ObjectLockLegalHoldStatus: head.ObjectLockLegalHoldStatus,
+	}
+	if expires, err := http.ParseTime(aws.StringValue(head.Expires)); err == nil {
+		input.Expires = aws.Time(expires)
+	}
+	if cacheControl != "" {
+		input.CacheControl = aws.String(cacheControl)
+	}
+	_, err = b.client().CopyObject(input)
+	return err
+}
+
+// deleteObjectsAttempts bounds how many times deleteObjects sends the keys that failed to be deleted.
+var deleteObjectsAttempts = 3
+
+//DeleteByPrefix ... deletes every object whose key starts with prefix
+func (b *Bucket) DeleteByPrefix(prefix string) error {
+	if b.s3Client == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(b.Name), Prefix: aws.String(prefix)}
+	for {
+		resp, err := b.client().ListObjectsV2(input)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(resp.Contents))
+		for _, object := range resp.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		if err := b.deleteObjects(keys); err != nil {
+			return err
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+//Empty ... deletes every object of the bucket
+func (b *Bucket) Empty() error {
+	return b.DeleteByPrefix("")
+}
+
+// deleteObjects deletes the keys in one batch, retrying the keys reported in Errors.
+func (b *Bucket) deleteObjects(keys []string) error {
+	failures := make([]string, 0)
+	for attempt := 0; attempt < deleteObjectsAttempts && len(keys) > 0; attempt++ {
+		objects := make([]*s3.ObjectIdentifier, 0, len(keys))
+		for _, key := range keys {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		resp, err := b.client().DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(b.Name),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		keys = make([]string, 0, len(resp.Errors))
+		failures = make([]string, 0, len(resp.Errors))
+		for _, e := range resp.Errors {
+			keys = append(keys, aws.StringValue(e.Key))
+			failures = append(failures, fmt.Sprintf("%s: %s %s", aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message)))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Unable to delete: [%s]", strings.Join(failures, ","))
+}
+
+//EnsureBucket ... creates the bucket unless it already exists
+func EnsureBucket(region, bucket string) error {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return ensureBucket(s3.New(sess), region, bucket)
+}
+func ensureBucket(s3Client s3iface.S3API, region, bucket string) error {
+	_, err := s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		return nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || (aerr.Code() != "NotFound" && aerr.Code() != s3.ErrCodeNoSuchBucket) {
+		return err
+	}
+
+	input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	// us-east-1 is the default location and is rejected as a location constraint
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
+	}
+	_, err = s3Client.CreateBucket(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+		return nil
+	}
+	return err
+}
+
+//UploadReader ... uploads the content of r to the given key
+func (b *Bucket) UploadReader(key string, r io.Reader) error {
+	if b.s3Client == nil && b.uploader == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	// without a client the ownership controls can't be read, the ACL is kept
+	useACL := true
+	if b.s3Client != nil {
+		var err error
+		if useACL, err = b.checkACL(); err != nil {
+			return err
+		}
+	}
+	input := &s3manager.UploadInput{}
+	awsutil.Copy(input, b.putObjectInput(key, nil, useACL))
+	if b.ChecksumAlgorithm != "" {
+		return b.uploadWithChecksum(input, r)
+	}
+	input.Body = r
+	_, err := b.newUploader().Upload(input)
+	return err
+}
+
+// checksumPartSize is the size of the parts of the UploadReader bodies sent with a checksum.
+var checksumPartSize = s3manager.DefaultUploadPartSize
+
+// uploadWithChecksum uploads r with its ChecksumAlgorithm checksum. A body smaller than a part is buffered
+// to compute it, a larger one is uploaded in parts with the checksum of each part, which the s3manager
+// uploader does not send.
+func (b *Bucket) uploadWithChecksum(input *s3manager.UploadInput, r io.Reader) error {
+	first, err := ioutil.ReadAll(io.LimitReader(r, checksumPartSize))
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) < checksumPartSize {
+		body := bytes.NewReader(first)
+		if err := b.setChecksum(input, body); err != nil {
+			return err
+		}
+		input.Body = body
+		_, err := b.newUploader().Upload(input)
+		return err
+	}
+	if b.s3Client == nil {
+		return fmt.Errorf("ChecksumAlgorithm needs the S3 client to upload more than %d bytes", checksumPartSize)
+	}
+	return b.uploadPartsWithChecksum(input, io.MultiReader(bytes.NewReader(first), r))
+}
+
+// uploadPartsWithChecksum uploads r in parts of checksumPartSize, one after the other, the upload is
+// aborted when a part fails.
+func (b *Bucket) uploadPartsWithChecksum(input *s3manager.UploadInput, r io.Reader) error {
+	ctx := context.Background()
+	create := &s3.CreateMultipartUploadInput{ChecksumAlgorithm: aws.String(b.ChecksumAlgorithm)}
+	awsutil.Copy(create, input)
+	resp, err := b.client().CreateMultipartUploadWithContext(ctx, create)
+	if err != nil {
+		return err
+	}
+	parts := make([]*s3.CompletedPart, 0)
+	err = func() error {
+		for number := int64(1); ; number++ {
+			buf := make([]byte, checksumPartSize)
+			n, err := io.ReadFull(r, buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			body := bytes.NewReader(buf[:n])
+			part := &s3.UploadPartInput{
+				Bucket:               input.Bucket,
+				Key:                  input.Key,
+				UploadId:             resp.UploadId,
+				PartNumber:           aws.Int64(number),
+				Body:                 body,
+				SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+				SSECustomerKey:       input.SSECustomerKey,
+			}
+			if err := b.setChecksum(part, body); err != nil {
+				return err
+			}
+			out, err := b.client().UploadPartWithContext(ctx, part)
+			if err != nil {
+				return err
+			}
+			completed := &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(number)}
+			awsutil.Copy(completed, part)
+			parts = append(parts, completed)
+			if n < len(buf) {
+				return nil
+			}
+		}
+	}()
+	if err == nil {
+		_, err = b.client().CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          input.Bucket,
+			Key:             input.Key,
+			UploadId:        resp.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		abort := &s3.AbortMultipartUploadInput{Bucket: input.Bucket, Key: input.Key, UploadId: resp.UploadId}
+		if _, abortErr := b.client().AbortMultipartUploadWithContext(ctx, abort); abortErr != nil {
+			log.Println("Unable to abort the upload: " + abortErr.Error())
+		}
+	}
+	return err
+}
+func (b *Bucket) newUploader() s3manageriface.UploaderAPI {
+	if b.uploader == nil {
+		return s3manager.NewUploaderWithClient(b.client())
+	}
+	if b.MetricsHook != nil {
+		return observedUploader{b.uploader, b.MetricsHook}
+	}
+	return b.uploader
+}
@@ -2,28 +2,302 @@
 package awsutils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
 /*Mock stuff*/
 type mockedS3Client struct {
 	s3iface.S3API
+	Keys      []string
+	Contents  map[string]string
+	ListInput *s3.ListObjectsV2Input
+	ListErr   error
+	Delay     time.Duration
+	CopyErr   error
+	CopyInput *s3.CopyObjectInput
+	Calls     []string
+	// Head is returned by HeadObject when set
+	Head *s3.HeadObjectOutput
+
+	PutObjectErr error
+	UploadPages  map[string]*s3.ListMultipartUploadsOutput
+	ListPages    map[string]*s3.ListObjectsV2Output
+	SelectEvents []s3.SelectObjectContentEventStreamEvent
+	// ObjectOwnership is returned by GetBucketOwnershipControls, empty means no controls
+	ObjectOwnership string
+	// OwnershipControlsErr is returned by GetBucketOwnershipControls when set
+	OwnershipControlsErr error
+	// DeleteFailures is the number of DeleteObjects calls reporting an error for a key
+	DeleteFailures    map[string]int
+	DeleteBatches     [][]string
+	HeadBucketErr     error
+	CreateBucketErr   error
+	CreateBucketInput *s3.CreateBucketInput
+	// ContentEncodings are returned by GetObject, keyed by key
+	ContentEncodings map[string]string
+
+	mu        sync.Mutex
+	Requested []string
+	Uploaded  []*s3.PutObjectInput
+	// UploadedBodies are the bodies read by PutObject, in the order of Uploaded
+	UploadedBodies []string
+	// MultipartCreated, UploadedParts (with PartBodies) and MultipartCompleted record a multipart upload
+	MultipartCreated   *s3.CreateMultipartUploadInput
+	UploadedParts      []*s3.UploadPartInput
+	PartBodies         []string
+	MultipartCompleted *s3.CompleteMultipartUploadInput
 }
 
-func (s *mockedS3Client) ListObjectsV2(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
-	key := "someKey"
-	contents := []*s3.Object{&s3.Object{Key: &key}}
+func (s *mockedS3Client) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	s.ListInput = in
+	if s.ListErr != nil {
+		return nil, s.ListErr
+	}
+	if s.Keys == nil {
+		key := "someKey"
+		contents := []*s3.Object{&s3.Object{Key: &key}}
+		return &s3.ListObjectsV2Output{Contents: contents}, nil
+	}
+	contents := make([]*s3.Object, 0)
+	for _, key := range s.Keys {
+		if in.StartAfter == nil || key > *in.StartAfter {
+			size := int64(len(s.Contents[key]))
+			contents = append(contents, &s3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(size),
+				ETag:         aws.String(`"etag-` + key + `"`),
+				LastModified: aws.Time(time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)),
+				StorageClass: aws.String(s3.ObjectStorageClassStandard),
+			})
+		}
+	}
 	return &s3.ListObjectsV2Output{Contents: contents}, nil
 }
 
-func (s *mockedS3Client) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+func (s *mockedS3Client) ListObjectsV2(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	s.ListInput = in
+	return s.ListPages[aws.StringValue(in.ContinuationToken)], nil
+}
+
+func (s *mockedS3Client) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if s.PutObjectErr != nil {
+		return nil, s.PutObjectErr
+	}
+	var body []byte
+	if in.Body != nil {
+		body, _ = ioutil.ReadAll(in.Body)
+	}
+	s.mu.Lock()
+	s.Uploaded = append(s.Uploaded, in)
+	s.UploadedBodies = append(s.UploadedBodies, string(body))
+	s.mu.Unlock()
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (s *mockedS3Client) CopyObject(in *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	s.Calls = append(s.Calls, "CopyObject "+*in.CopySource+" "+*in.Key)
+	s.CopyInput = in
+	if s.CopyErr != nil {
+		return nil, s.CopyErr
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (s *mockedS3Client) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if _, ok := s.Contents[*in.Key]; !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	if s.Head != nil {
+		return s.Head, nil
+	}
+	return &s3.HeadObjectOutput{ContentType: aws.String("text/html")}, nil
+}
+
+func (s *mockedS3Client) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	s.Calls = append(s.Calls, "DeleteObject "+*in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (s *mockedS3Client) ListMultipartUploads(in *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	return s.UploadPages[aws.StringValue(in.KeyMarker)+"/"+aws.StringValue(in.UploadIdMarker)], nil
+}
+
+func (s *mockedS3Client) AbortMultipartUpload(in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	s.Calls = append(s.Calls, "AbortMultipartUpload "+*in.Key+" "+*in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (s *mockedS3Client) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return s.AbortMultipartUpload(in)
+}
+
+func (s *mockedS3Client) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	s.MultipartCreated = in
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (s *mockedS3Client) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.UploadedParts = append(s.UploadedParts, in)
+	s.PartBodies = append(s.PartBodies, string(body))
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"etag-%d"`, *in.PartNumber))}, nil
+}
+
+func (s *mockedS3Client) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	s.MultipartCompleted = in
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (s *mockedS3Client) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	keys := make([]string, 0)
+	out := &s3.DeleteObjectsOutput{}
+	for _, object := range in.Delete.Objects {
+		keys = append(keys, *object.Key)
+		if s.DeleteFailures[*object.Key] > 0 {
+			s.DeleteFailures[*object.Key]--
+			out.Errors = append(out.Errors, &s3.Error{Key: object.Key, Code: aws.String("InternalError"), Message: aws.String("try again")})
+		}
+	}
+	s.DeleteBatches = append(s.DeleteBatches, keys)
+	return out, nil
+}
+
+func (s *mockedS3Client) SelectObjectContent(in *s3.SelectObjectContentInput) (*s3.SelectObjectContentOutput, error) {
+	events := make(chan s3.SelectObjectContentEventStreamEvent, len(s.SelectEvents))
+	for _, event := range s.SelectEvents {
+		events <- event
+	}
+	close(events)
+	return &s3.SelectObjectContentOutput{
+		EventStream: s3.NewSelectObjectContentEventStream(func(es *s3.SelectObjectContentEventStream) {
+			es.Reader = &mockedSelectReader{events: events}
+			es.StreamCloser = ioutil.NopCloser(nil)
+		}),
+	}, nil
+}
+
+type mockedSelectReader struct {
+	events chan s3.SelectObjectContentEventStreamEvent
+}
+
+func (r *mockedSelectReader) Events() <-chan s3.SelectObjectContentEventStreamEvent { return r.events }
+func (r *mockedSelectReader) Close() error                                          { return nil }
+func (r *mockedSelectReader) Err() error                                            { return nil }
+
+func (s *mockedS3Client) GetBucketOwnershipControls(in *s3.GetBucketOwnershipControlsInput) (*s3.GetBucketOwnershipControlsOutput, error) {
+	if s.OwnershipControlsErr != nil {
+		return nil, s.OwnershipControlsErr
+	}
+	if s.ObjectOwnership == "" {
+		return nil, awserr.New("OwnershipControlsNotFoundError", "The bucket ownership controls were not found", nil)
+	}
+	rule := &s3.OwnershipControlsRule{ObjectOwnership: aws.String(s.ObjectOwnership)}
+	return &s3.GetBucketOwnershipControlsOutput{
+		OwnershipControls: &s3.OwnershipControls{Rules: []*s3.OwnershipControlsRule{rule}},
+	}, nil
+}
+
+func (s *mockedS3Client) HeadBucket(in *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	if s.HeadBucketErr != nil {
+		return nil, s.HeadBucketErr
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (s *mockedS3Client) CreateBucket(in *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
+	s.CreateBucketInput = in
+	if s.CreateBucketErr != nil {
+		return nil, s.CreateBucketErr
+	}
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (s *mockedS3Client) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	s.mu.Lock()
+	s.Requested = append(s.Requested, *in.Key)
+	s.mu.Unlock()
+	select {
+	case <-time.After(s.Delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if content, ok := s.Contents[*in.Key]; ok {
+		out := rangedGetObjectOutput(content, aws.StringValue(in.Range))
+		if encoding, ok := s.ContentEncodings[*in.Key]; ok {
+			out.ContentEncoding = aws.String(encoding)
+		}
+		return out, nil
+	}
 	return nil, errors.New("bad stuff! Try next file")
 }
 
+// rangedGetObjectOutput serves the requested byte range of content like S3 does.
+func rangedGetObjectOutput(content, rng string) *s3.GetObjectOutput {
+	var start, end int
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+		return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(content)), ContentLength: aws.Int64(int64(len(content)))}
+	}
+	if end >= len(content) {
+		end = len(content) - 1
+	}
+	part := ""
+	if start <= end {
+		part = content[start : end+1]
+	}
+	return &s3.GetObjectOutput{
+		Body:         ioutil.NopCloser(strings.NewReader(part)),
+		ContentRange: aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(content))),
+	}
+}
+
+type mockedUploader struct {
+	s3manageriface.UploaderAPI
+	mu     sync.Mutex
+	Inputs []*s3manager.UploadInput
+	Bodies []string
+}
+
+func (u *mockedUploader) Upload(in *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Inputs = append(u.Inputs, in)
+	u.Bodies = append(u.Bodies, string(body))
+	return &s3manager.UploadOutput{}, nil
+}
+
 func TestDownloadBucket(t *testing.T) {
 
 	b := Bucket{}
@@ -38,6 +312,14 @@ func TestDownloadBucket(t *testing.T) {
 	if err != nil {
 		t.Errorf(err.Error())
 	}
+
+	// Missing bucket
+	mock := &mockedS3Client{ListErr: awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)}
+	b = NewBucket(mock, "Missing", "temp")
+	err = b.DownloadBucket(nil)
+	if !errors.Is(err, ErrBucketNotFound) || !strings.Contains(err.Error(), "Missing") {
+		t.Errorf("Expected error :%s, and got %v", ErrBucketNotFound, err)
+	}
 }
 
 func TestUploadEmptyBucket(t *testing.T) {
@@ -48,10 +330,1195 @@ func TestUploadEmptyBucket(t *testing.T) {
 	if err.Error() != messageClientNotDefined {
 		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
 	}
+	// A missing directory is not an empty one
 	b = NewBucket(&mockedS3Client{}, "Bucket", "NotADir")
+	b.AllowEmpty = true
+	err = b.UploadBucket()
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, and got %v", err)
+	}
+}
 
+func TestUploadEmptyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewBucket(&mockedS3Client{}, "Bucket", dir)
+	err = b.UploadBucket()
+	if err == nil || err.Error() != messageNoFilesToUpload {
+		t.Errorf("Expected error :%s, and got %v", messageNoFilesToUpload, err)
+	}
+
+	b.AllowEmpty = true
 	err = b.UploadBucket()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 }
+
+func TestUploadBucketSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempFile("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outside.Name())
+	outside.Close()
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("file"), 0644)
+	if err := os.Symlink(outside.Name(), filepath.Join(dir, "link.txt")); err != nil {
+		t.Skip("symlinks not supported: " + err.Error())
+	}
+
+	keys := func(mock *mockedS3Client) string {
+		result := make([]string, 0)
+		for _, input := range mock.Uploaded {
+			result = append(result, *input.Key)
+		}
+		sort.Strings(result)
+		return strings.Join(result, ",")
+	}
+
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if keys(mock) != "file.txt" {
+		t.Errorf("Expected the symlink to be skipped, and got %s", keys(mock))
+	}
+
+	mock = &mockedS3Client{}
+	b = NewBucket(mock, "Bucket", dir)
+	b.FollowSymlinks = true
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if keys(mock) != "file.txt,link.txt" {
+		t.Errorf("Expected the symlink to be followed, and got %s", keys(mock))
+	}
+}
+
+func TestDownloadBucketStartAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockedS3Client{Keys: []string{"a", "b", "c", "d"}}
+	b := NewBucket(mock, "Bucket", dir)
+	b.StartAfter = "b"
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.ListInput.StartAfter == nil || *mock.ListInput.StartAfter != "b" {
+		t.Errorf("Expected StartAfter to be forwarded to the listing")
+	}
+	sort.Strings(mock.Requested)
+	if len(mock.Requested) != 2 || mock.Requested[0] != "c" || mock.Requested[1] != "d" {
+		t.Errorf("Expected only keys after b to be downloaded, and got %v", mock.Requested)
+	}
+}
+
+func TestDownloadBucketDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f func(string) (uint64, error)) { availableDiskSpace = f }(availableDiskSpace)
+	availableDiskSpace = func(string) (uint64, error) { return 100, nil }
+
+	// 60 bytes to download
+	contents := map[string]string{"a": strings.Repeat("a", 20), "b": strings.Repeat("b", 40)}
+	mock := &mockedS3Client{Keys: []string{"a", "b"}, Contents: contents}
+	b := NewBucket(mock, "Bucket", dir)
+	b.CheckDiskSpace = true
+	b.DiskSpaceHeadroom = 50
+	err = b.DownloadBucket(nil)
+	if err == nil || err.Error() != "Not enough disk space in "+dir+": 110 bytes needed, 100 available" {
+		t.Errorf("Expected not enough disk space error, and got %v", err)
+	}
+	if len(mock.Requested) != 0 {
+		t.Errorf("Expected nothing downloaded, and got %v", mock.Requested)
+	}
+
+	b.DiskSpaceHeadroom = 40
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.Requested) != 2 {
+		t.Errorf("Expected 2 downloads, and got %v", mock.Requested)
+	}
+}
+
+func TestDownloadBucketDecompressGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gzipped := func(content string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(content))
+		gz.Close()
+		return buf.String()
+	}
+	mock := &mockedS3Client{
+		Keys: []string{"logs/app.log.gz", "page.html", "plain.txt"},
+		Contents: map[string]string{
+			"logs/app.log.gz": gzipped("log line\n"),
+			"page.html":       gzipped("<html></html>"),
+			"plain.txt":       "plain",
+		},
+		ContentEncodings: map[string]string{"page.html": "gzip"},
+	}
+	b := NewBucket(mock, "Bucket", dir)
+	b.DecompressGzip = true
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"logs/app.log": "log line\n", "page.html": "<html></html>", "plain.txt": "plain"}
+	for name, content := range expected {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: expected %q, and got %q %v", name, content, got, err)
+		}
+	}
+	if fileExists(filepath.Join(dir, "logs/app.log.gz")) {
+		t.Errorf("Expected the .gz file name to be stripped")
+	}
+
+	// The decompressed file is the one the OverwritePolicy and the manifest refer to
+	b.OverwritePolicy = Fail
+	if err := b.DownloadBucket(nil); err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "logs/app.log")) {
+		t.Errorf("Expected the decompressed file to exist, and got %v", err)
+	}
+	b.OverwritePolicy = Overwrite
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := b.DownloadWithManifest(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest []ManifestEntry
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 3 || manifest[0].Key != "logs/app.log.gz" || manifest[0].LocalPath != filepath.Join(dir, "logs/app.log") {
+		t.Errorf("Expected the decompressed local path, and got %v", manifest)
+	}
+
+	// Corrupted archive
+	mock.Contents["logs/app.log.gz"] = "not gzip"
+	if err := b.getFromS3(context.Background(), "logs/app.log.gz"); err == nil || !strings.Contains(err.Error(), "Unable to decompress") {
+		t.Errorf("Expected decompress error, and got %v", err)
+	}
+
+	// A truncated archive leaves neither a partial file nor a temporary one
+	truncated := gzipped("truncated content")
+	mock.Contents["cut.txt.gz"] = truncated[:len(truncated)-6]
+	if err := b.getFromS3(context.Background(), "cut.txt.gz"); err == nil || !strings.Contains(err.Error(), "Unable to download") {
+		t.Errorf("Expected download error, and got %v", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*cut.txt*")); len(tmp) != 0 {
+		t.Errorf("Expected no file left behind, and got %v", tmp)
+	}
+
+	// Keys downloaded to the same file are rejected before downloading anything
+	collision, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(collision)
+	mock = &mockedS3Client{
+		Keys:     []string{"x.gz", "x"},
+		Contents: map[string]string{"x.gz": gzipped("compressed"), "x": "plain"},
+	}
+	b = NewBucket(mock, "Bucket", collision)
+	b.DecompressGzip = true
+	if err := b.DownloadBucket(nil); err == nil || !strings.Contains(err.Error(), "both downloaded to") {
+		t.Errorf("Expected collision error, and got %v", err)
+	}
+	if fileExists(filepath.Join(collision, "x")) {
+		t.Errorf("Expected nothing to be downloaded")
+	}
+}
+
+func TestUploadBucketObjectLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	retainUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	b.ObjectLockMode = s3.ObjectLockModeCompliance
+	b.ObjectLockRetainUntilDate = retainUntil
+	b.ObjectLockLegalHoldStatus = s3.ObjectLockLegalHoldStatusOn
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if len(mock.Uploaded) != 1 {
+		t.Fatalf("Expected one upload, and got %d", len(mock.Uploaded))
+	}
+	input := mock.Uploaded[0]
+	if aws.StringValue(input.ObjectLockMode) != s3.ObjectLockModeCompliance ||
+		!aws.TimeValue(input.ObjectLockRetainUntilDate).Equal(retainUntil) ||
+		aws.StringValue(input.ObjectLockLegalHoldStatus) != s3.ObjectLockLegalHoldStatusOn {
+		t.Errorf("Object lock settings were not forwarded: %v", input)
+	}
+
+	// Default unset keeps the fields empty
+	plain := NewBucket(mock, "Bucket", dir)
+	if input := plain.putObjectInput("key", nil, false); input.ObjectLockMode != nil || input.ObjectLockRetainUntilDate != nil || input.ObjectLockLegalHoldStatus != nil {
+		t.Errorf("Object lock settings should be unset by default")
+	}
+}
+
+func TestDownloadBucketTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockedS3Client{Keys: []string{"a", "b"}, Delay: time.Minute}
+	b := NewBucket(mock, "Bucket", dir)
+	b.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err = b.DownloadBucket(nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected error :%s, and got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("The download was not aborted by the timeout")
+	}
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	b := Bucket{}
+	err := b.UpdateMetadata("key", nil, "")
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedS3Client{Contents: map[string]string{"index.html": "<html/>"}}
+	b = NewBucket(mock, "Bucket", "temp")
+	err = b.UpdateMetadata("index.html", map[string]string{"version": "2"}, "max-age=60")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	in := mock.CopyInput
+	if *in.Key != "index.html" || *in.CopySource != "Bucket%2Findex.html" || *in.MetadataDirective != s3.MetadataDirectiveReplace {
+		t.Errorf("Expected a replace copy onto the same key, and got %v", in)
+	}
+	if *in.CacheControl != "max-age=60" || *in.Metadata["version"] != "2" || *in.ContentType != "text/html" {
+		t.Errorf("Unexpected metadata: %v", in)
+	}
+
+	// The other headers are kept
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.Head = &s3.HeadObjectOutput{
+		ContentType:        aws.String("text/html"),
+		ContentEncoding:    aws.String("gzip"),
+		ContentDisposition: aws.String("inline"),
+		ContentLanguage:    aws.String("en"),
+		CacheControl:       aws.String("max-age=300"),
+		Expires:            aws.String(expires.Format(http.TimeFormat)),
+
+		StorageClass:            aws.String(s3.StorageClassStandardIa),
+		ServerSideEncryption:    aws.String(s3.ServerSideEncryptionAwsKms),
+		SSEKMSKeyId:             aws.String("arn:aws:kms:us-east-1:111111111111:key/object"),
+		WebsiteRedirectLocation: aws.String("/new.html"),
+	}
+	if err := b.UpdateMetadata("index.html", nil, ""); err != nil {
+		t.Errorf(err.Error())
+	}
+	in = mock.CopyInput
+	if aws.StringValue(in.ContentEncoding) != "gzip" || aws.StringValue(in.ContentDisposition) != "inline" || aws.StringValue(in.ContentLanguage) != "en" ||
+		aws.StringValue(in.CacheControl) != "max-age=300" || !aws.TimeValue(in.Expires).Equal(expires) {
+		t.Errorf("Expected the headers of the object, and got %v", in)
+	}
+	if aws.StringValue(in.StorageClass) != s3.StorageClassStandardIa || aws.StringValue(in.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms ||
+		aws.StringValue(in.SSEKMSKeyId) != "arn:aws:kms:us-east-1:111111111111:key/object" || aws.StringValue(in.WebsiteRedirectLocation) != "/new.html" {
+		t.Errorf("Expected the storage class, KMS key and redirect of the object, and got %v", in)
+	}
+	if err := b.UpdateMetadata("index.html", nil, "no-cache"); err != nil || aws.StringValue(mock.CopyInput.CacheControl) != "no-cache" {
+		t.Errorf("Expected the given Cache-Control, and got %v %v", mock.CopyInput.CacheControl, err)
+	}
+
+	if err := b.UpdateMetadata("missing", nil, ""); err == nil {
+		t.Errorf("Expected error for a missing object")
+	}
+}
+
+func TestMoveObject(t *testing.T) {
+	b := Bucket{}
+	err := b.MoveObject("src", "dest")
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedS3Client{}
+	b = NewBucket(mock, "Bucket", "temp")
+	if err := b.MoveObject("dir/src", "dest"); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.Calls) != 2 || mock.Calls[0] != "CopyObject Bucket%2Fdir%2Fsrc dest" || mock.Calls[1] != "DeleteObject dir/src" {
+		t.Errorf("Expected copy before delete, and got %v", mock.Calls)
+	}
+
+	// Copy fails, the source must be kept
+	mock = &mockedS3Client{CopyErr: errors.New("AccessDenied")}
+	b = NewBucket(mock, "Bucket", "temp")
+	if err := b.MoveObject("src", "dest"); err == nil {
+		t.Errorf("Expected copy error")
+	}
+	if len(mock.Calls) != 1 {
+		t.Errorf("Expected delete to be skipped, and got %v", mock.Calls)
+	}
+}
+
+func TestBytesTransferred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockedS3Client{
+		Keys:     []string{"a", "dir/b", "missing"},
+		Contents: map[string]string{"a": "12345", "dir/b": "1234567890"},
+	}
+	b := NewBucket(mock, "Bucket", dir)
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Errorf(err.Error())
+	}
+	if b.BytesTransferred() != 15 {
+		t.Errorf("Expected 15 bytes transferred, and got %d", b.BytesTransferred())
+	}
+}
+
+func TestDownloadBucketOverwritePolicy(t *testing.T) {
+	tests := []struct {
+		policy   OverwritePolicy
+		content  string
+		hasError bool
+	}{
+		{Overwrite, "new", false},
+		{Skip, "old", false},
+		{Fail, "old", true},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "download")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fileName := filepath.Join(dir, "a")
+		if err := ioutil.WriteFile(fileName, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		mock := &mockedS3Client{Keys: []string{"a"}, Contents: map[string]string{"a": "new"}}
+		b := NewBucket(mock, "Bucket", dir)
+		b.OverwritePolicy = test.policy
+		err = b.DownloadBucket(nil)
+		if (err != nil) != test.hasError {
+			t.Errorf("Policy %d: unexpected error %v", test.policy, err)
+		}
+		content, _ := ioutil.ReadFile(fileName)
+		if string(content) != test.content {
+			t.Errorf("Policy %d: expected content %s, and got %s", test.policy, test.content, content)
+		}
+	}
+}
+
+func TestDownloaderConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockedS3Client{Keys: []string{"a"}, Contents: map[string]string{"a": "0123456789"}}
+	b := NewBucket(mock, "Bucket", dir)
+	downloader := b.newDownloader()
+	if downloader.PartSize != s3manager.DefaultDownloadPartSize || downloader.Concurrency != s3manager.DefaultDownloadConcurrency {
+		t.Errorf("Expected the s3manager defaults")
+	}
+
+	b.DownloadPartSize = 3
+	b.DownloadConcurrency = 2
+	downloader = b.newDownloader()
+	if downloader.PartSize != 3 || downloader.Concurrency != 2 {
+		t.Errorf("Expected part size 3 and concurrency 2, and got %d and %d", downloader.PartSize, downloader.Concurrency)
+	}
+
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Errorf(err.Error())
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "a"))
+	if string(content) != "0123456789" {
+		t.Errorf("Unexpected content: %s", content)
+	}
+	if len(mock.Requested) != 4 {
+		t.Errorf("Expected 4 ranged requests, and got %d", len(mock.Requested))
+	}
+}
+
+func TestDownloadWithManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := Bucket{}
+	err = b.DownloadWithManifest(filepath.Join(dir, "manifest.json"))
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedS3Client{
+		Keys:     []string{"b/two", "one", "broken"},
+		Contents: map[string]string{"one": "1", "b/two": "22"},
+	}
+	localDir := filepath.Join(dir, "data")
+	b = NewBucket(mock, "Bucket", localDir)
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := b.DownloadWithManifest(manifestPath); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest []ManifestEntry
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("Expected two downloaded objects, and got %v", manifest)
+	}
+	entry := manifest[0]
+	if entry.Key != "b/two" || entry.Size != 2 || entry.ETag != `"etag-b/two"` || entry.StorageClass != s3.ObjectStorageClassStandard ||
+		!entry.LastModified.Equal(time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)) || entry.LocalPath != filepath.Join(localDir, "b/two") {
+		t.Errorf("Unexpected manifest entry: %v", entry)
+	}
+	if manifest[1].Key != "one" || manifest[1].Size != 1 {
+		t.Errorf("Unexpected manifest entry: %v", manifest[1])
+	}
+}
+
+func TestInitializeS3Accelerate(t *testing.T) {
+	b := Bucket{Name: "Bucket"}
+	b.InitializeS3("eu-west-1")
+	client, ok := b.s3Client.(*s3.S3)
+	if !ok {
+		t.Fatalf("Expected an S3 client")
+	}
+	if aws.BoolValue(client.Config.S3UseAccelerate) {
+		t.Errorf("Transfer acceleration should be disabled by default")
+	}
+
+	b.UseAccelerate = true
+	b.InitializeS3("eu-west-1")
+	client = b.s3Client.(*s3.S3)
+	if !aws.BoolValue(client.Config.S3UseAccelerate) || aws.StringValue(client.Config.Region) != "eu-west-1" {
+		t.Errorf("Expected transfer acceleration to be enabled")
+	}
+}
+
+func TestEnsureBucketExisting(t *testing.T) {
+	mock := &mockedS3Client{}
+	if err := ensureBucket(mock, "eu-west-1", "Bucket"); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.CreateBucketInput != nil {
+		t.Errorf("An existing bucket should not be created")
+	}
+}
+
+func TestEnsureBucketMissing(t *testing.T) {
+	notFound := awserr.New("NotFound", "Not Found", nil)
+
+	mock := &mockedS3Client{HeadBucketErr: notFound}
+	if err := ensureBucket(mock, "eu-west-1", "Bucket"); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.CreateBucketInput == nil || *mock.CreateBucketInput.CreateBucketConfiguration.LocationConstraint != "eu-west-1" {
+		t.Errorf("Expected the bucket to be created in eu-west-1")
+	}
+
+	mock = &mockedS3Client{HeadBucketErr: notFound}
+	if err := ensureBucket(mock, "us-east-1", "Bucket"); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.CreateBucketInput == nil || mock.CreateBucketInput.CreateBucketConfiguration != nil {
+		t.Errorf("Expected the bucket to be created without location constraint in us-east-1")
+	}
+
+	// Other errors are returned
+	mock = &mockedS3Client{HeadBucketErr: awserr.New("Forbidden", "Forbidden", nil)}
+	if err := ensureBucket(mock, "eu-west-1", "Bucket"); err == nil || mock.CreateBucketInput != nil {
+		t.Errorf("Expected the error to be returned without creating the bucket")
+	}
+}
+
+func TestEnsureBucketOwned(t *testing.T) {
+	mock := &mockedS3Client{
+		HeadBucketErr:   awserr.New("NotFound", "Not Found", nil),
+		CreateBucketErr: awserr.New(s3.ErrCodeBucketAlreadyOwnedByYou, "already owned", nil),
+	}
+	if err := ensureBucket(mock, "eu-west-1", "Bucket"); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	mock.CreateBucketErr = awserr.New(s3.ErrCodeBucketAlreadyExists, "already exists", nil)
+	if err := ensureBucket(mock, "eu-west-1", "Bucket"); err == nil {
+		t.Errorf("Expected error for a bucket owned by someone else")
+	}
+}
+
+func TestUploadReader(t *testing.T) {
+	b := Bucket{}
+	err := b.UploadReader("key", bytes.NewReader(nil))
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	uploader := &mockedUploader{}
+	b = NewBucket(&mockedS3Client{}, "Bucket", "temp")
+	b.uploader = uploader
+	b.ObjectLockMode = s3.ObjectLockModeGovernance
+	if err := b.UploadReader("reports/report.txt", bytes.NewReader([]byte("report"))); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(uploader.Inputs) != 1 {
+		t.Fatalf("Expected one upload, and got %d", len(uploader.Inputs))
+	}
+	input := uploader.Inputs[0]
+	if *input.Bucket != "Bucket" || *input.Key != "reports/report.txt" || uploader.Bodies[0] != "report" {
+		t.Errorf("Unexpected upload: %v", input)
+	}
+	if aws.StringValue(input.ObjectLockMode) != s3.ObjectLockModeGovernance {
+		t.Errorf("Expected the bucket options to be applied")
+	}
+
+	// Concurrent uploads of a bucket with an ACL
+	uploader = &mockedUploader{}
+	b.uploader = uploader
+	b.ACL = s3.ObjectCannedACLPublicRead
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := b.UploadReader(fmt.Sprintf("report-%d.txt", i), bytes.NewReader(nil)); err != nil {
+				t.Errorf(err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, input := range uploader.Inputs {
+		if aws.StringValue(input.ACL) != s3.ObjectCannedACLPublicRead {
+			t.Errorf("Expected ACL %s, and got %v", s3.ObjectCannedACLPublicRead, input.ACL)
+		}
+	}
+}
+
+func TestUploadChecksumAlgorithm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "report.txt"), []byte("report"), 0644)
+
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	if err := b.UploadBucket(); err != nil {
+		t.Fatal(err)
+	}
+	if mock.Uploaded[0].ChecksumAlgorithm != nil || mock.Uploaded[0].ChecksumSHA256 != nil {
+		t.Errorf("Expected no checksum, and got %v", mock.Uploaded[0])
+	}
+
+	// The checksum is computed from the content, which is still sent in full
+	expected := map[string]string{
+		s3.ChecksumAlgorithmCrc32:  "xC93hA==",
+		s3.ChecksumAlgorithmCrc32c: "4o5Tvw==",
+		s3.ChecksumAlgorithmSha1:   "onKXvelzLy5z+8BtsmEXZOOtmFU=",
+		s3.ChecksumAlgorithmSha256: "hF6RgxMZ6JxNZWvbgMJ4rAmnIw1h5d/S4bH7tDasiRc=",
+	}
+	for algorithm, sum := range expected {
+		mock.Uploaded, mock.UploadedBodies = nil, nil
+		b.ChecksumAlgorithm = algorithm
+		if err := b.UploadBucket(); err != nil {
+			t.Fatal(err)
+		}
+		input := mock.Uploaded[0]
+		got := map[string]*string{
+			s3.ChecksumAlgorithmCrc32:  input.ChecksumCRC32,
+			s3.ChecksumAlgorithmCrc32c: input.ChecksumCRC32C,
+			s3.ChecksumAlgorithmSha1:   input.ChecksumSHA1,
+			s3.ChecksumAlgorithmSha256: input.ChecksumSHA256,
+		}[algorithm]
+		if aws.StringValue(input.ChecksumAlgorithm) != algorithm || aws.StringValue(got) != sum {
+			t.Errorf("%s: expected checksum %s, and got %v", algorithm, sum, aws.StringValue(got))
+		}
+		if mock.UploadedBodies[0] != "report" {
+			t.Errorf("%s: expected the full body, and got %q", algorithm, mock.UploadedBodies[0])
+		}
+	}
+
+	// Unsupported cases
+	mock.Uploaded = nil
+	b.ChecksumAlgorithm = "MD5"
+	b.UploadBucket()
+	if len(mock.Uploaded) != 0 {
+		t.Errorf("Expected no upload with an invalid algorithm")
+	}
+}
+
+func TestUploadReaderChecksumAlgorithm(t *testing.T) {
+	uploader := &mockedUploader{}
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", "temp")
+	b.uploader = uploader
+	b.ChecksumAlgorithm = s3.ChecksumAlgorithmSha256
+	if err := b.UploadReader("report.txt", bytes.NewReader([]byte("report"))); err != nil {
+		t.Fatal(err)
+	}
+	input := uploader.Inputs[0]
+	if aws.StringValue(input.ChecksumAlgorithm) != s3.ChecksumAlgorithmSha256 || aws.StringValue(input.ChecksumSHA256) != "hF6RgxMZ6JxNZWvbgMJ4rAmnIw1h5d/S4bH7tDasiRc=" ||
+		uploader.Bodies[0] != "report" {
+		t.Errorf("Expected the checksum to be forwarded, and got %v", input)
+	}
+
+	// Larger bodies are uploaded in parts, each with its checksum
+	defer func(size int64) { checksumPartSize = size }(checksumPartSize)
+	checksumPartSize = 4
+	sha := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	for body, expected := range map[string][]string{"0123456789": {"0123", "4567", "89"}, "01234567": {"0123", "4567"}} {
+		mock.UploadedParts, mock.PartBodies = nil, nil
+		if err := b.UploadReader("report.txt", strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		if aws.StringValue(mock.MultipartCreated.ChecksumAlgorithm) != s3.ChecksumAlgorithmSha256 || !reflect.DeepEqual(mock.PartBodies, expected) {
+			t.Fatalf("Expected parts %v, and got %v", expected, mock.PartBodies)
+		}
+		completed := mock.MultipartCompleted.MultipartUpload.Parts
+		for i, part := range mock.UploadedParts {
+			if aws.StringValue(part.ChecksumSHA256) != sha(expected[i]) || aws.StringValue(completed[i].ChecksumSHA256) != sha(expected[i]) ||
+				aws.Int64Value(completed[i].PartNumber) != int64(i+1) || aws.StringValue(completed[i].ETag) != fmt.Sprintf(`"etag-%d"`, i+1) {
+				t.Errorf("Unexpected part %d: %v %v", i+1, part, completed[i])
+			}
+		}
+	}
+
+	// Parts need the S3 client
+	b = Bucket{Name: "Bucket", uploader: uploader, ChecksumAlgorithm: s3.ChecksumAlgorithmSha256}
+	if err := b.UploadReader("report.txt", strings.NewReader("0123456789")); err == nil {
+		t.Errorf("Expected error without S3 client")
+	}
+}
+
+func TestUploadBucketCacheHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("js"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("html"), 0644)
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	b.CacheControl = "max-age=31536000"
+	b.CacheControlByExtension = map[string]string{".html": "no-cache"}
+	b.Expires = &expires
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	headers := make(map[string]string)
+	for _, input := range mock.Uploaded {
+		headers[*input.Key] = aws.StringValue(input.CacheControl)
+		if !aws.TimeValue(input.Expires).Equal(expires) {
+			t.Errorf("Expected Expires to be set on %s", *input.Key)
+		}
+	}
+	if headers["app.js"] != "max-age=31536000" || headers["index.html"] != "no-cache" {
+		t.Errorf("Unexpected Cache-Control headers: %v", headers)
+	}
+}
+
+func TestUploadBucketDetectContentType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index"), []byte("<!DOCTYPE html><html><body>hi</body></html>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte("body {}"), 0644)
+
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	b.DetectContentType = true
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	types := make(map[string]string)
+	for _, input := range mock.Uploaded {
+		types[*input.Key] = aws.StringValue(input.ContentType)
+	}
+	if types["index"] != "text/html; charset=utf-8" || !strings.HasPrefix(types["style.css"], "text/css") {
+		t.Errorf("Unexpected content types: %v", types)
+	}
+
+	// The sniffed body is rewound
+	body := strings.NewReader("<html></html>")
+	detectContentType("page", body)
+	if offset, _ := body.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Errorf("Expected the body to be rewound, and got offset %d", offset)
+	}
+}
+
+func TestUploadBucketACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("html"), 0644)
+
+	tests := map[string]*string{
+		"":                                     aws.String(s3.ObjectCannedACLPublicRead),
+		s3.ObjectOwnershipBucketOwnerPreferred: aws.String(s3.ObjectCannedACLPublicRead),
+		s3.ObjectOwnershipBucketOwnerEnforced:  nil,
+	}
+	for ownership, expected := range tests {
+		mock := &mockedS3Client{ObjectOwnership: ownership}
+		b := NewBucket(mock, "Bucket", dir)
+		b.ACL = s3.ObjectCannedACLPublicRead
+		if err := b.UploadBucket(); err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(mock.Uploaded) != 1 || aws.StringValue(mock.Uploaded[0].ACL) != aws.StringValue(expected) {
+			t.Errorf("%s: expected ACL %v, and got %v", ownership, aws.StringValue(expected), mock.Uploaded)
+		}
+	}
+
+	// Without s3:GetBucketOwnershipControls the ACL is kept
+	mock := &mockedS3Client{OwnershipControlsErr: awserr.New("AccessDenied", "Access Denied", nil)}
+	b := NewBucket(mock, "Bucket", dir)
+	b.ACL = s3.ObjectCannedACLPublicRead
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.Uploaded) != 1 || aws.StringValue(mock.Uploaded[0].ACL) != s3.ObjectCannedACLPublicRead {
+		t.Errorf("Expected ACL %s, and got %v", s3.ObjectCannedACLPublicRead, mock.Uploaded)
+	}
+
+	// Other errors fail the upload
+	mock = &mockedS3Client{OwnershipControlsErr: awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)}
+	b = NewBucket(mock, "Bucket", dir)
+	b.ACL = s3.ObjectCannedACLPublicRead
+	if err := b.UploadBucket(); err == nil || len(mock.Uploaded) != 0 {
+		t.Errorf("Expected error and no upload, and got %v", err)
+	}
+}
+
+func TestUploadBucketTagging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "logs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "logs", "app.log"), []byte("log"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("html"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "readme.txt"), []byte("txt"), 0644)
+
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	b.TaggingFunc = func(key string) map[string]string {
+		switch {
+		case strings.HasPrefix(key, "logs/"):
+			return map[string]string{"retention": "30d", "team": "ops & infra"}
+		case strings.HasSuffix(key, ".html"):
+			return map[string]string{"public": "true"}
+		}
+		return nil
+	}
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	tagging := make(map[string]*string)
+	for _, input := range mock.Uploaded {
+		tagging[*input.Key] = input.Tagging
+	}
+	if aws.StringValue(tagging["logs/app.log"]) != "retention=30d&team=ops+%26+infra" {
+		t.Errorf("Unexpected tagging for logs/app.log: %v", aws.StringValue(tagging["logs/app.log"]))
+	}
+	if aws.StringValue(tagging["index.html"]) != "public=true" {
+		t.Errorf("Unexpected tagging for index.html: %v", aws.StringValue(tagging["index.html"]))
+	}
+	if tagging["readme.txt"] != nil {
+		t.Errorf("Expected no tagging for readme.txt, and got %v", *tagging["readme.txt"])
+	}
+}
+
+func TestUploadBucketKeyFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "Docs"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "Docs", "README.md"), []byte("readme"), 0644)
+
+	// Lowercased keys
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "Bucket", dir)
+	b.KeyFunc = func(localPath, defaultKey string) (string, error) {
+		return strings.ToLower(defaultKey), nil
+	}
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.Uploaded) != 1 || *mock.Uploaded[0].Key != "docs/readme.md" {
+		t.Errorf("Expected a lowercased key, and got %v", mock.Uploaded)
+	}
+
+	// Content addressed keys
+	mock = &mockedS3Client{}
+	b = NewBucket(mock, "Bucket", dir)
+	b.KeyPrefix = "cas"
+	b.KeyFunc = func(localPath, defaultKey string) (string, error) {
+		content, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("sha256/%x", sha256.Sum256(content)), nil
+	}
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := fmt.Sprintf("cas/sha256/%x", sha256.Sum256([]byte("readme")))
+	if len(mock.Uploaded) != 1 || *mock.Uploaded[0].Key != expected {
+		t.Errorf("Expected key %s, and got %v", expected, mock.Uploaded)
+	}
+
+	// A failing KeyFunc skips the file
+	mock = &mockedS3Client{}
+	b = NewBucket(mock, "Bucket", dir)
+	b.KeyFunc = func(localPath, defaultKey string) (string, error) {
+		return "", errors.New("no key")
+	}
+	b.UploadBucket()
+	if len(mock.Uploaded) != 0 {
+		t.Errorf("Expected nothing uploaded, and got %v", mock.Uploaded)
+	}
+}
+
+func TestUploadBucketKeyPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "css"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "css", "app.css"), []byte("css"), 0644)
+
+	for _, prefix := range []string{"releases/v1", "releases/v1/"} {
+		mock := &mockedS3Client{}
+		b := NewBucket(mock, "Bucket", dir)
+		b.KeyPrefix = prefix
+		if err := b.UploadBucket(); err != nil {
+			t.Errorf(err.Error())
+		}
+		if len(mock.Uploaded) != 1 || *mock.Uploaded[0].Key != "releases/v1/css/app.css" {
+			t.Errorf("Expected key releases/v1/css/app.css, and got %v", mock.Uploaded)
+		}
+	}
+}
+
+func TestUploadBucketDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	mock := &mockedS3Client{}
+	b := NewBucket(mock, "bucket", dir)
+	b.DryRun = true
+	if err := b.UploadBucket(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.Uploaded) != 1 || *mock.Uploaded[0].Key == "a.txt" {
+		t.Errorf("Expected only the preflight object, and got %v", mock.Uploaded)
+	}
+	if len(mock.Calls) != 1 || mock.Calls[0] != "DeleteObject "+*mock.Uploaded[0].Key {
+		t.Errorf("Expected the preflight object to be deleted, and got %v", mock.Calls)
+	}
+
+	// Access denied
+	mock = &mockedS3Client{PutObjectErr: awserr.New("AccessDenied", "Access Denied", nil)}
+	b = NewBucket(mock, "bucket", dir)
+	b.DryRun = true
+	err = b.UploadBucket()
+	if err == nil || !strings.Contains(err.Error(), "Access denied to bucket bucket") {
+		t.Errorf("Expected access denied error, and got %v", err)
+	}
+}
+
+func multipartUpload(key, id string, age time.Duration) *s3.MultipartUpload {
+	return &s3.MultipartUpload{Key: aws.String(key), UploadId: aws.String(id), Initiated: aws.Time(time.Now().Add(-age))}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	sError := Bucket{}
+	_, err := sError.ListMultipartUploads()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedS3Client{UploadPages: map[string]*s3.ListMultipartUploadsOutput{
+		"/": {
+			Uploads:            []*s3.MultipartUpload{multipartUpload("old", "1", 48*time.Hour)},
+			IsTruncated:        aws.Bool(true),
+			NextKeyMarker:      aws.String("old"),
+			NextUploadIdMarker: aws.String("1"),
+		},
+		"old/1": {Uploads: []*s3.MultipartUpload{multipartUpload("new", "2", time.Minute)}},
+	}}
+	b := NewBucket(mock, "bucket", "")
+	uploads, err := b.ListMultipartUploads()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(uploads) != 2 {
+		t.Errorf("Expected 2 uploads across pages, and got %d", len(uploads))
+	}
+
+	if err := b.AbortMultipartUpload("key", "id"); err != nil {
+		t.Errorf(err.Error())
+	}
+	aborted, err := b.AbortStaleMultipartUploads(24 * time.Hour)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := []string{"AbortMultipartUpload key id", "AbortMultipartUpload old 1"}
+	if aborted != 1 || strings.Join(mock.Calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, and got %d %v", expected, aborted, mock.Calls)
+	}
+}
+
+func TestCountObjects(t *testing.T) {
+	sError := Bucket{}
+	_, err := sError.CountObjects("")
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedS3Client{ListPages: map[string]*s3.ListObjectsV2Output{
+		"":     {KeyCount: aws.Int64(1000), IsTruncated: aws.Bool(true), NextContinuationToken: aws.String("next")},
+		"next": {KeyCount: aws.Int64(42)},
+	}}
+	b := NewBucket(mock, "bucket", "")
+	count, err := b.CountObjects("logs/")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if count != 1042 {
+		t.Errorf("Expected 1042 objects, and got %d", count)
+	}
+	if *mock.ListInput.Prefix != "logs/" {
+		t.Errorf("Expected prefix logs/, and got %s", *mock.ListInput.Prefix)
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	sError := Bucket{}
+	err := sError.Empty()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	objects := func(keys ...string) []*s3.Object {
+		result := make([]*s3.Object, 0)
+		for _, key := range keys {
+			result = append(result, &s3.Object{Key: aws.String(key)})
+		}
+		return result
+	}
+	mock := &mockedS3Client{
+		ListPages: map[string]*s3.ListObjectsV2Output{
+			"":     {Contents: objects("a", "b", "c"), IsTruncated: aws.Bool(true), NextContinuationToken: aws.String("next")},
+			"next": {Contents: objects("d")},
+		},
+		DeleteFailures: map[string]int{"b": 1},
+	}
+	b := NewBucket(mock, "bucket", "")
+	if err := b.DeleteByPrefix("logs/"); err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := [][]string{{"a", "b", "c"}, {"b"}, {"d"}}
+	if fmt.Sprint(mock.DeleteBatches) != fmt.Sprint(expected) {
+		t.Errorf("Expected batches %v, and got %v", expected, mock.DeleteBatches)
+	}
+
+	// Keys that keep failing are reported
+	mock.DeleteFailures = map[string]int{"c": deleteObjectsAttempts}
+	mock.DeleteBatches = nil
+	err = b.Empty()
+	if err == nil || err.Error() != "Unable to delete: [c: InternalError try again]" {
+		t.Errorf("Expected aggregated error, and got %v", err)
+	}
+	if len(mock.DeleteBatches) != deleteObjectsAttempts {
+		t.Errorf("Expected %d batches, and got %v", deleteObjectsAttempts, mock.DeleteBatches)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	sError := Bucket{}
+	_, err := sError.Select("key", "", nil, nil)
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	input := &s3.InputSerialization{CSV: &s3.CSVInput{FileHeaderInfo: aws.String(s3.FileHeaderInfoUse)}}
+	output := &s3.OutputSerialization{CSV: &s3.CSVOutput{}}
+	mock := &mockedS3Client{SelectEvents: []s3.SelectObjectContentEventStreamEvent{
+		&s3.RecordsEvent{Payload: []byte("a,1\n")},
+		&s3.StatsEvent{},
+		&s3.RecordsEvent{Payload: []byte("b,2\n")},
+		&s3.EndEvent{},
+	}}
+	b := NewBucket(mock, "bucket", "")
+	records, err := b.Select("data.csv", "SELECT * FROM S3Object s WHERE s.size > 0", input, output)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if string(records) != "a,1\nb,2\n" {
+		t.Errorf("Unexpected records: %q", records)
+	}
+
+	// Stream without an EndEvent
+	mock.SelectEvents = mock.SelectEvents[:1]
+	if _, err := b.Select("data.csv", "SELECT * FROM S3Object", input, output); err == nil {
+		t.Errorf("Expected error for incomplete results")
+	}
+}
+
+func TestDownloadKeys(t *testing.T) {
+	sError := Bucket{}
+	err := sError.DownloadKeys([]string{"a"})
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockedS3Client{Contents: map[string]string{"a.txt": "a", "dir/b.txt": "b", "c.txt": "c"}}
+	b := NewBucket(mock, "bucket", dir)
+	if err := b.DownloadKeys([]string{"a.txt", "dir/b.txt"}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.ListInput != nil {
+		t.Errorf("Expected the bucket not to be listed")
+	}
+	sort.Strings(mock.Requested)
+	if strings.Join(mock.Requested, ",") != "a.txt,dir/b.txt" {
+		t.Errorf("Expected only the listed keys, and got %v", mock.Requested)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "dir", "b.txt")); string(content) != "b" {
+		t.Errorf("Unexpected content: %s", content)
+	}
+}
+
+func TestDownloadBucketStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state")
+	ioutil.WriteFile(stateFile, []byte("a.txt\n"), 0644)
+
+	contents := map[string]string{"a.txt": "a", "b.txt": "b"}
+	mock := &mockedS3Client{Keys: []string{"a.txt", "b.txt"}, Contents: contents}
+	b := NewBucket(mock, "bucket", filepath.Join(dir, "files"))
+	b.StateFile = stateFile
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(mock.Requested, ",") != "b.txt" {
+		t.Errorf("Expected only b.txt to be downloaded, and got %v", mock.Requested)
+	}
+	state, _ := ioutil.ReadFile(stateFile)
+	if string(state) != "a.txt\nb.txt\n" {
+		t.Errorf("Unexpected state: %q", state)
+	}
+
+	// Second run has nothing left to do
+	mock = &mockedS3Client{Keys: []string{"a.txt", "b.txt"}, Contents: contents}
+	b = NewBucket(mock, "bucket", filepath.Join(dir, "files"))
+	b.StateFile = stateFile
+	if err := b.DownloadBucket(nil); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.Requested) != 0 {
+		t.Errorf("Expected nothing to be downloaded, and got %v", mock.Requested)
+	}
+	// A key cut by an interrupted append is downloaded again, the state is compacted
+	ioutil.WriteFile(stateFile, []byte("b.txt\na.txt\nb.txt\na.t"), 0644)
+	completed, err := b.loadState()
+	if err != nil || len(completed) != 2 || completed["a.t"] {
+		t.Errorf("Expected a.txt and b.txt, and got %v %v", completed, err)
+	}
+	file, err := b.openState(completed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("c.txt\n")
+	file.Close()
+	content, _ := ioutil.ReadFile(stateFile)
+	if string(content) != "a.txt\nb.txt\nc.txt\n" {
+		t.Errorf("Unexpected state: %q", content)
+	}
+}
@@ -2,68 +2,538 @@ package awsutils
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
+// Logger is where a Stack reports what it is doing, *log.Logger satisfies it.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+var defaultLogger Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// logStatusFailed is the status of the events reporting an error.
+const logStatusFailed = "FAILED"
+
+//LogEvent ... a structured log entry of a Stack
+type LogEvent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Stack     string    `json:"stack"`
+	Status    string    `json:"status,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (e LogEvent) String() string {
+	switch {
+	case e.Message != "" && e.Error != "":
+		return e.Message + ": " + e.Error
+	case e.Message != "":
+		return e.Message
+	}
+	return e.Error
+}
+
+// EventLogger is a Logger that receives the structured events instead of text lines.
+type EventLogger interface {
+	Logger
+	LogEvent(event LogEvent)
+}
+
+//JSONLogger ... an EventLogger that writes every event as a JSON object on its own line
+type JSONLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+//NewJSONLogger ... creates a JSONLogger writing to out
+func NewJSONLogger(out io.Writer) *JSONLogger {
+	return &JSONLogger{out: out}
+}
+
+//Println ... logs a free text message
+func (l *JSONLogger) Println(v ...interface{}) {
+	l.LogEvent(LogEvent{Message: strings.TrimSuffix(fmt.Sprintln(v...), "\n")})
+}
+
+//LogEvent ... writes the event as a JSON line
+func (l *JSONLogger) LogEvent(event LogEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// templatePresignExpiry is how long the presigned template URLs are valid.
+var templatePresignExpiry = 15 * time.Minute
+
+// clientRequestTokenWindow is how long the generated client request tokens stay the same across processes.
+var clientRequestTokenWindow = 5 * time.Minute
+
+// stackPollInterval is the delay between DescribeStacks calls while polling a stack.
+var stackPollInterval = 10 * time.Second
+
+// busyRetryBackoff is the delay before the first retry of a busy stack, it doubles on each retry up to
+// busyRetryMaxBackoff.
+var busyRetryBackoff = 5 * time.Second
+var busyRetryMaxBackoff = time.Minute
+
 //Stack ... Aws Cloud formation stack
 type Stack struct {
-	cfn          cloudformationiface.CloudFormationAPI
-	Name         string
-	TemplateURL  string
+	cfn         cloudformationiface.CloudFormationAPI
+	Name        string
+	TemplateURL string
+	// TemplateBody is used instead of TemplateURL when set.
+	TemplateBody string
 	Capabilities []string
 	Status       *string
+	// StackID is set on the stacks returned by GetAllStacksBy and by CreateOrUpdate.
+	StackID string
+	// Logger overrides the standard logger when set.
+	Logger Logger
+	// MetricsHook observes every CloudFormation call of the stack when set.
+	MetricsHook MetricsHook
+	// RequiredOverride lists parameters that must be supplied even if the template has a default.
+	RequiredOverride []string
+	// AutoExecute makes CreateOrUpdate execute the change set it creates for an existing stack.
+	AutoExecute bool
+	// ChangeSetName is the name of the last change set created, to review it before ExecuteChangeSet.
+	ChangeSetName string
+	// Tags are applied to the stack when it is created and by every change set.
+	Tags map[string]string
+	// NotificationARNs are the SNS topics receiving the stack events, empty keeps the ones already set.
+	NotificationARNs []string
+	// OnFailure (DO_NOTHING, ROLLBACK or DELETE) and DisableRollback control what happens when the creation
+	// of the stack fails, only one of them can be set. They don't apply to updates.
+	OnFailure       string
+	DisableRollback bool
+	// TimeoutInMinutes bounds the creation of the stack, zero leaves it to CloudFormation.
+	TimeoutInMinutes int64
+	// EnableTerminationProtection protects the stack from deletion as soon as it is created.
+	EnableTerminationProtection bool
+	// RoleARN is the service role CloudFormation assumes to create and update the stack resources.
+	RoleARN string
+	// CleanupOnFailure makes CreateOrUpdate delete the stack when its creation fails, or cancel the
+	// update in progress and wait for the rollback when the update of an AutoExecute change set fails.
+	// Only what CreateOrUpdate itself started is cleaned up. It cannot be set with DisableRollback or
+	// OnFailure DO_NOTHING, which ask to keep a failed stack.
+	CleanupOnFailure bool
+	// UsePreviousValues makes the change sets of CreateOrUpdate keep the deployed value of the template
+	// parameters that are not supplied, instead of resetting them to the template default.
+	UsePreviousValues bool
+	// RecreateFailedStacks makes CreateOrUpdate delete and create again a stack whose creation failed
+	// (ROLLBACK_COMPLETE or ROLLBACK_FAILED), as such stacks cannot be updated.
+	RecreateFailedStacks bool
+	// BusyRetries is how many times CreateOrUpdate is retried when the stack is busy with another operation
+	// (e.g. UPDATE_IN_PROGRESS), each retry waits for the stack to settle and then backs off.
+	BusyRetries int
+	// StreamNextOperation makes StreamEvents and WriteEvents, started on a settled stack, wait for the next
+	// operation instead of returning, so they can be started just before CreateOrUpdate.
+	StreamNextOperation bool
+	// ClientRequestToken makes CloudFormation ignore retries of a request it already received, it must be unique
+	// for each deploy and is sent suffixed with the operation name. When empty a token is derived from the
+	// operation, the stack name and the change set or stack id it applies to, so retries from another process
+	// within clientRequestTokenWindow are deduplicated. A Stack never sends the same token twice.
+	ClientRequestToken string
+	// Region selects the defaults registered with WithRegionDefaults.
+	Region         string
+	regionDefaults map[string]map[string]string
+	// usedTokens counts the request tokens sent, replacedStackID is the failed stack deleted to be created again
+	usedTokens      map[string]int
+	replacedStackID string
+	presigner       s3iface.S3API
+}
+
+const (
+	// DeployActionCreated is the DeployResult action of a stack that did not exist.
+	DeployActionCreated = "created"
+	// DeployActionChangeSet is the DeployResult action of an existing stack, a change set was prepared for it.
+	DeployActionChangeSet = "changeset"
+)
+
+//DeployResult ... what CreateOrUpdateResult did
+type DeployResult struct {
+	Action        string
+	ChangeSetName string
+	StackId       string
+}
+
+// ErrNoChanges is returned, wrapped in a StackError, when a change set is not created because
+// the template and parameters match the deployed stack. Check it with errors.Is.
+var ErrNoChanges = errors.New("No changes to deploy")
+
+// StackError is returned by Stack methods when an operation on a stack fails.
+type StackError struct {
+	Name string
+	Op   string
+	Err  error
+}
+
+func (e *StackError) Error() string {
+	return e.Op + " " + e.Name + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StackError) Unwrap() error {
+	return e.Err
 }
 
 func NewStack(client cloudformationiface.CloudFormationAPI, name, templateURL string, capabilities []string) Stack {
 	return Stack{cfn: client, Name: name, TemplateURL: templateURL, Capabilities: capabilities}
 }
 
-// func (s *Stack) InitilizeCfn(region string) {
-// 	sess := session.Must(session.NewSession(&aws.Config{
-// 		Region: aws.String(region),
-// 	}))
-// 	s.cfn = cloudformation.New(sess)
-// }
+func (s *Stack) wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StackError{Name: s.Name, Op: op, Err: err}
+}
+
+// requestToken returns the token of op on subject (a change set name or stack id): ClientRequestToken suffixed
+// with op or, when it is empty, a token derived from op, the stack name, subject and the current
+// clientRequestTokenWindow. A token already sent by s gets a sequence number, as it is a new operation.
+func (s *Stack) requestToken(op, subject string) *string {
+	var token string
+	if s.ClientRequestToken != "" {
+		token = s.ClientRequestToken + "-" + op
+	} else {
+		window := time.Now().Truncate(clientRequestTokenWindow).Unix()
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%d", op, s.Name, subject, window)))
+		token = fmt.Sprintf("awsutils-%s-%x", op, sum[:16])
+	}
+	if s.usedTokens == nil {
+		s.usedTokens = make(map[string]int)
+	}
+	s.usedTokens[token]++
+	if n := s.usedTokens[token]; n > 1 {
+		token = fmt.Sprintf("%s-%d", token, n)
+	}
+	return aws.String(token)
+}
+
+// client returns the CloudFormation client, reporting its calls to MetricsHook when set.
+func (s *Stack) client() cloudformationiface.CloudFormationAPI {
+	if s.MetricsHook == nil {
+		return s.cfn
+	}
+	return observedCloudFormation{s.cfn, s.MetricsHook}
+}
+
+func (s *Stack) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return defaultLogger
+}
+
+func (s *Stack) logEvent(event LogEvent) {
+	event.Stack = s.Name
+	if l, ok := s.logger().(EventLogger); ok {
+		l.LogEvent(event)
+		return
+	}
+	s.logger().Println(event.String())
+}
+
+//InitilizeCfn ... creates the CloudFormation client used by the stack for the given region
+func (s *Stack) InitilizeCfn(region string) {
+	s.InitializeCfnWithConfig(&aws.Config{
+		Region: aws.String(region),
+	})
+}
+
+//InitializeCfnWithConfig ... creates the CloudFormation client from the given config, e.g. to use other
+//credentials or a custom endpoint
+func (s *Stack) InitializeCfnWithConfig(cfg *aws.Config) {
+	sess := session.Must(session.NewSession(cfg))
+	s.cfn = cloudformation.New(sess)
+}
 
 //CreateOrUpdate ... creates a stack or creates a change set for an existing stack based on given parameters
 func (s *Stack) CreateOrUpdate(parameters map[string]string) error {
+	return s.CreateOrUpdateWithContext(context.Background(), parameters)
+}
+
+//CreateOrUpdateWithContext ... same as CreateOrUpdate, returns ctx.Err() when the context is done
+func (s *Stack) CreateOrUpdateWithContext(ctx context.Context, parameters map[string]string) error {
+	_, err := s.createOrUpdateRetrying(ctx, parameters)
+	return err
+}
+
+//CreateOrUpdateResult ... same as CreateOrUpdate, also tells whether the stack was created or a change set
+//was prepared for it
+func (s *Stack) CreateOrUpdateResult(parameters map[string]string) (DeployResult, error) {
+	return s.createOrUpdateRetrying(context.Background(), parameters)
+}
+
+// createOrUpdateRetrying retries createOrUpdate up to BusyRetries times while the stack is busy.
+func (s *Stack) createOrUpdateRetrying(ctx context.Context, parameters map[string]string) (DeployResult, error) {
+	backoff := busyRetryBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := s.createOrUpdate(ctx, parameters)
+		if err == nil || attempt >= s.BusyRetries || !isStackBusy(err) {
+			return result, err
+		}
+		s.logEvent(LogEvent{Operation: "CreateOrUpdate", Message: fmt.Sprintf("Stack %s is busy, retrying (%d/%d)", s.Name, attempt+1, s.BusyRetries), Error: err.Error()})
+		if _, err := s.WaitUntilSettled(ctx); err != nil {
+			return result, err
+		}
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = nextBusyRetryBackoff(backoff)
+	}
+}
 
+// nextBusyRetryBackoff doubles backoff, capped at busyRetryMaxBackoff.
+func nextBusyRetryBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > busyRetryMaxBackoff {
+		return busyRetryMaxBackoff
+	}
+	return backoff
+}
+
+// isStackBusy tells if err is CloudFormation refusing an operation because another one is in progress.
+func isStackBusy(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "_IN_PROGRESS state")
+}
+func (s *Stack) createOrUpdate(ctx context.Context, parameters map[string]string) (DeployResult, error) {
+	result := DeployResult{}
 	if s.cfn == nil {
-		return fmt.Errorf(messageClientNotDefined)
+		return result, fmt.Errorf(messageClientNotDefined)
 	}
 
-	templateParam, err := s.getTeplateParameters()
+	validation, err := s.validateTemplate(ctx)
 	if err != nil {
-		fmt.Println(err.Error())
-		return err
+		s.logEvent(LogEvent{Operation: "CreateOrUpdate", Status: logStatusFailed, Error: err.Error()})
+		return result, s.wrapError("CreateOrUpdate", err)
 	}
+	// detected for this call only, explicit capabilities win
+	capabilities := s.Capabilities
+	if len(capabilities) == 0 {
+		capabilities = detectCapabilities(validation)
+	}
+	templateParam := templateParameters(validation)
 
-	if err := findMissingParametres(templateParam, parameters); err != nil {
-		log.Println(err.Error())
-		return err
+	input := cloudformation.DescribeStacksInput{StackName: &s.Name}
+	existing, err := s.client().DescribeStacksWithContext(ctx, &input)
+
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err != nil && !isStackNotFound(err) {
+		s.logEvent(LogEvent{Operation: "CreateOrUpdate", Status: logStatusFailed, Error: err.Error()})
+		return result, s.wrapError("CreateOrUpdate", err)
+	}
+	exists := err == nil
+	recreate := exists && s.RecreateFailedStacks && len(existing.Stacks) > 0 && isFailedCreateStatus(aws.StringValue(existing.Stacks[0].StackStatus))
+
+	// with UsePreviousValues the parameters of the deployed stack count as supplied
+	previous := make(map[string]bool)
+	if s.UsePreviousValues && exists && !recreate && len(existing.Stacks) > 0 {
+		for _, parameter := range existing.Stacks[0].Parameters {
+			previous[aws.StringValue(parameter.ParameterKey)] = true
+		}
+	}
+	parameters = withDefaults(parameters, s.regionDefaults[s.Region])
+	supplied := withPreviousKeys(parameters, previous)
+	templateParam = withRequiredOverride(templateParam, s.RequiredOverride)
+	if err := findMissingParametres(templateParam, supplied); err != nil {
+		// report them in the order the template groups them
+		err = findMissingParametresInOrder(templateParam, supplied, s.parameterOrder(ctx))
+		s.logEvent(LogEvent{Operation: "CreateOrUpdate", Status: logStatusFailed, Error: err.Error()})
+		return result, s.wrapError("CreateOrUpdate", err)
+	}
+
+	// YAML bodies are left to CloudFormation
+	if s.TemplateBody != "" && isJSONTemplate(s.TemplateBody) {
+		if err := ValidateParameterConstraints(s.TemplateBody, parameters); err != nil {
+			s.logEvent(LogEvent{Operation: "CreateOrUpdate", Status: logStatusFailed, Error: err.Error()})
+			return result, s.wrapError("CreateOrUpdate", err)
+		}
+	}
+
+	if defaulted := findDefaultedParameters(templateParam, supplied); len(defaulted) > 0 {
+		s.logEvent(LogEvent{Operation: "CreateOrUpdate", Message: fmt.Sprintf("Using template defaults for: [%s]", strings.Join(defaulted, ","))})
 	}
 
 	cfnParameters := convertToRequiredCfnParameter(templateParam, parameters)
-	input := cloudformation.DescribeStacksInput{StackName: &s.Name}
-	_, err = s.cfn.DescribeStacks(&input)
+	if recreate {
+		if err := s.deleteFailedStack(existing.Stacks[0]); err != nil {
+			return result, s.wrapError("CreateOrUpdate", err)
+		}
+		exists = false
+	}
+	if !exists {
+		result.Action = DeployActionCreated
+		var stackID string
+		stackID, err = s.createStack(ctx, cfnParameters, capabilities)
+		if err != nil && stackID != "" && s.CleanupOnFailure {
+			s.cleanupFailedCreate(stackID)
+		}
+	} else {
+		result.Action = DeployActionChangeSet
+		if len(existing.Stacks) > 0 {
+			s.StackID = aws.StringValue(existing.Stacks[0].StackId)
+		}
+		if s.UsePreviousValues {
+			cfnParameters = convertToPreviousCfnParameter(templateParam, parameters, previous)
+		}
+		var changeSetName string
+		changeSetName, err = s.createChangeSet(ctx, cfnParameters, capabilities)
+		if err == nil {
+			s.ChangeSetName = changeSetName
+			result.ChangeSetName = changeSetName
+			if s.AutoExecute {
+				var executed bool
+				executed, err = s.executeChangeSet(ctx, changeSetName)
+				switch {
+				// only an update started by this call is ours to cancel
+				case err != nil && executed && s.CleanupOnFailure:
+					s.cleanupFailedUpdate()
+				// a retry creates a change set of its own
+				case err != nil && !executed && isStackBusy(err):
+					s.deleteChangeSet(ctx, changeSetName)
+					s.ChangeSetName, result.ChangeSetName = "", ""
+				}
+			}
+		}
+	}
+	result.StackId = s.StackID
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	return result, s.wrapError("CreateOrUpdate", err)
+}
+
+func isFailedCreateStatus(status string) bool {
+	return status == cloudformation.StackStatusRollbackComplete || status == cloudformation.StackStatusRollbackFailed
+}
+
+// deleteFailedStack deletes a stack that can't be updated so it can be created again, the creation then
+// gets a request token of its own.
+func (s *Stack) deleteFailedStack(stack *cloudformation.Stack) error {
+	status := aws.StringValue(stack.StackStatus)
+	s.logEvent(LogEvent{Operation: "DeleteStack", Status: status, Message: "Stack " + s.Name + " is in " + status + ", deleting it to create it again"})
+	stackID := aws.StringValue(stack.StackId)
+	if stackID == "" {
+		stackID = s.Name
+	}
+	if err := s.deleteStackByID(stackID); err != nil {
+		s.logEvent(LogEvent{Operation: "DeleteStack", Status: logStatusFailed, Message: "Unable to delete " + s.Name, Error: err.Error()})
+		return err
+	}
+	s.replacedStackID = stackID
+	return nil
+}
 
+//Exists ... tells whether the stack exists, only the "does not exist" ValidationError of DescribeStacks
+//means it doesn't, any other error is returned
+func (s *Stack) Exists() (bool, error) {
+	if s.cfn == nil {
+		return false, fmt.Errorf(messageClientNotDefined)
+	}
+	exists, err := s.exists(context.Background())
+	return exists, s.wrapError("Exists", err)
+}
+func (s *Stack) exists(ctx context.Context) (bool, error) {
+	_, err := s.client().DescribeStacksWithContext(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)})
 	if err != nil {
-		err = s.createStack(cfnParameters)
-	} else {
-		err = s.createChangeSet(cfnParameters)
+		if isStackNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isStackNotFound tells if err is the ValidationError CloudFormation returns for a stack that does not exist.
+func isStackNotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "does not exist")
+}
+
+// cleanupFailedCreate deletes, by id, the stack whose creation failed. The cleanup error is only logged.
+func (s *Stack) cleanupFailedCreate(stackID string) {
+	s.logEvent(LogEvent{Operation: "DeleteStack", Status: cloudformation.StackStatusDeleteInProgress, Message: "Creation of " + s.Name + " failed, deleting the stack"})
+	if err := s.deleteStackByID(stackID); err != nil {
+		s.logEvent(LogEvent{Operation: "DeleteStack", Status: logStatusFailed, Message: "Unable to delete " + s.Name, Error: err.Error()})
+	}
+}
+
+// deleteStackByID deletes the stack with the given id and waits for it, unlike the name the id can't
+// refer to a stack created since by someone else.
+func (s *Stack) deleteStackByID(stackID string) error {
+	input := &cloudformation.DeleteStackInput{StackName: aws.String(stackID), ClientRequestToken: s.requestToken("DeleteStack", stackID)}
+	if _, err := s.client().DeleteStack(input); err != nil {
+		return err
+	}
+	return s.client().WaitUntilStackDeleteComplete(&cloudformation.DescribeStacksInput{StackName: aws.String(stackID)})
+}
+
+// cleanupFailedUpdate cancels an update still in progress and waits for the stack to roll back to
+// its last good state, the cleanup error is only logged.
+func (s *Stack) cleanupFailedUpdate() {
+	ctx := context.Background()
+	res, err := s.client().DescribeStacksWithContext(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)})
+	if err != nil || len(res.Stacks) == 0 || aws.StringValue(res.Stacks[0].StackStatus) != cloudformation.StackStatusUpdateInProgress {
+		return
+	}
+	s.logEvent(LogEvent{Operation: "CancelUpdateStack", Status: cloudformation.StackStatusUpdateRollbackInProgress, Message: "Update of " + s.Name + " failed, cancelling the update"})
+	if _, err := s.client().CancelUpdateStack(&cloudformation.CancelUpdateStackInput{StackName: aws.String(s.Name)}); err != nil {
+		s.logEvent(LogEvent{Operation: "CancelUpdateStack", Status: logStatusFailed, Message: "Unable to cancel the update of " + s.Name, Error: err.Error()})
+		return
+	}
+	if err := s.WaitForRollback(ctx); err != nil {
+		s.logEvent(LogEvent{Operation: "CancelUpdateStack", Status: logStatusFailed, Error: err.Error()})
 	}
-	return err
 }
 func findMissingParametres(templateParam map[string]*string, parameters map[string]string) error {
+	return findMissingParametresInOrder(templateParam, parameters, nil)
+}
+
+// findMissingParametresInOrder reports the missing parameters sorted by order, then alphabetically.
+func findMissingParametresInOrder(templateParam map[string]*string, parameters map[string]string, order []string) error {
 	missing := make([]string, 0)
 	for key, defaultValue := range templateParam {
 		_, doesKeyExist := parameters[key]
@@ -74,8 +544,76 @@ func findMissingParametres(templateParam map[string]*string, parameters map[stri
 	if len(missing) == 0 {
 		return nil
 	}
+	sortByOrder(missing, order)
 	return fmt.Errorf("Missing: [%s]", strings.Join(missing, ","))
 }
+
+func (s *Stack) templateSummaryInput() *cloudformation.GetTemplateSummaryInput {
+	if s.TemplateBody != "" {
+		return &cloudformation.GetTemplateSummaryInput{TemplateBody: aws.String(s.TemplateBody)}
+	}
+	return &cloudformation.GetTemplateSummaryInput{TemplateURL: aws.String(s.TemplateURL)}
+}
+
+// parameterOrder returns the parameter order of the template interface metadata, nil if it can't be read.
+func (s *Stack) parameterOrder(ctx context.Context) []string {
+	resp, err := s.client().GetTemplateSummaryWithContext(ctx, s.templateSummaryInput())
+	if err != nil {
+		return nil
+	}
+	return parameterGroupOrder([]byte(aws.StringValue(resp.Metadata)))
+}
+
+//WithRegionDefaults ... registers parameter values used when the stack is deployed to region and
+//the caller does not supply them, they take precedence over the template defaults
+func (s *Stack) WithRegionDefaults(region string, defaults map[string]string) {
+	if s.regionDefaults == nil {
+		s.regionDefaults = make(map[string]map[string]string)
+	}
+	s.regionDefaults[region] = defaults
+}
+
+// withDefaults returns a copy of parameters completed with the defaults it does not set.
+func withDefaults(parameters, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return parameters
+	}
+	result := make(map[string]string)
+	for key, value := range defaults {
+		result[key] = value
+	}
+	for key, value := range parameters {
+		result[key] = value
+	}
+	return result
+}
+
+// withRequiredOverride returns a copy of templateParam where the required keys have no default.
+func withRequiredOverride(templateParam map[string]*string, required []string) map[string]*string {
+	if len(required) == 0 {
+		return templateParam
+	}
+	result := make(map[string]*string)
+	for key, defaultValue := range templateParam {
+		result[key] = defaultValue
+	}
+	for _, key := range required {
+		if _, ok := result[key]; ok {
+			result[key] = nil
+		}
+	}
+	return result
+}
+func findDefaultedParameters(templateParam map[string]*string, parameters map[string]string) []string {
+	defaulted := make([]string, 0)
+	for key, defaultValue := range templateParam {
+		if _, doesKeyExist := parameters[key]; !doesKeyExist && defaultValue != nil {
+			defaulted = append(defaulted, key)
+		}
+	}
+	sort.Strings(defaulted)
+	return defaulted
+}
 func convertToCfnParameter(parameters map[string]string) []*cloudformation.Parameter {
 	result := make([]*cloudformation.Parameter, 0)
 	for key, value := range parameters {
@@ -86,6 +624,49 @@ func convertToCfnParameter(parameters map[string]string) []*cloudformation.Param
 	}
 	return result
 }
+func convertToCfnTags(tags map[string]string) []*cloudformation.Tag {
+	result := make([]*cloudformation.Tag, 0)
+	for key, value := range tags {
+		result = append(result, &cloudformation.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+	return result
+}
+
+// convertToPreviousCfnParameter sends the template parameters in parameters, the ones not in parameters keep
+// their deployed value when the stack has them (previous) and the template default otherwise.
+func convertToPreviousCfnParameter(templateParam map[string]*string, parameters map[string]string, previous map[string]bool) []*cloudformation.Parameter {
+	result := make([]*cloudformation.Parameter, 0, len(templateParam))
+	for key := range templateParam {
+		parameter := &cloudformation.Parameter{ParameterKey: aws.String(key)}
+		if value, ok := parameters[key]; ok {
+			parameter.ParameterValue = aws.String(value)
+		} else if previous[key] {
+			parameter.UsePreviousValue = aws.Bool(true)
+		} else {
+			continue
+		}
+		result = append(result, parameter)
+	}
+	return result
+}
+
+// withPreviousKeys adds the keys of the deployed parameters to parameters, for the checks of what is supplied.
+func withPreviousKeys(parameters map[string]string, previous map[string]bool) map[string]string {
+	if len(previous) == 0 {
+		return parameters
+	}
+	result := make(map[string]string, len(parameters)+len(previous))
+	for key := range previous {
+		result[key] = ""
+	}
+	for key, value := range parameters {
+		result[key] = value
+	}
+	return result
+}
 func convertToRequiredCfnParameter(templateParam map[string]*string, parameters map[string]string) []*cloudformation.Parameter {
 	result := make([]*cloudformation.Parameter, 0)
 	for key := range templateParam {
@@ -102,28 +683,535 @@ func convertToRequiredCfnParameter(templateParam map[string]*string, parameters
 
 //ReadOutputs ...
 func (s *Stack) ReadOutputs() (map[string]string, error) {
+	return s.ReadOutputsWithContext(context.Background())
+}
+
+//ReadOutputsWithContext ... same as ReadOutputs with a context
+func (s *Stack) ReadOutputsWithContext(ctx context.Context) (map[string]string, error) {
 	if s.cfn == nil {
 		return nil, fmt.Errorf(messageClientNotDefined)
 	}
 	parameters := make(map[string]string)
 	input := cloudformation.DescribeStacksInput{StackName: &s.Name}
 
-	res, err := s.cfn.DescribeStacks(&input)
+	res, err := s.client().DescribeStacksWithContext(ctx, &input)
+	if err != nil {
+		return nil, s.wrapError("ReadOutputs", err)
+	}
+	for _, stack := range res.Stacks {
+		for _, output := range stack.Outputs {
+			parameters[*output.OutputKey] = *output.OutputValue
+		}
+	}
+	return parameters, nil
+}
+
+//Output ... a stack output, ExportName is empty when the output is not exported
+type Output struct {
+	Value       string
+	Description string
+	ExportName  string
+}
+
+//ReadOutputsWithExports ... same as ReadOutputs, also returns the description and export name of the outputs
+func (s *Stack) ReadOutputsWithExports() (map[string]Output, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	res, err := s.client().DescribeStacksWithContext(context.Background(), &cloudformation.DescribeStacksInput{StackName: &s.Name})
+	if err != nil {
+		return nil, s.wrapError("ReadOutputsWithExports", err)
+	}
+	outputs := make(map[string]Output)
+	for _, stack := range res.Stacks {
+		for _, output := range stack.Outputs {
+			outputs[aws.StringValue(output.OutputKey)] = Output{
+				Value:       aws.StringValue(output.OutputValue),
+				Description: aws.StringValue(output.Description),
+				ExportName:  aws.StringValue(output.ExportName),
+			}
+		}
+	}
+	return outputs, nil
+}
+
+//ReadOutput ... returns the value of a single output of the stack
+func (s *Stack) ReadOutput(key string) (string, error) {
+	outputs, err := s.ReadOutputs()
+	if err != nil {
+		return "", err
+	}
+	value, ok := outputs[key]
+	if !ok {
+		return "", s.wrapError("ReadOutput", fmt.Errorf("output %q not found", key))
+	}
+	return value, nil
+}
+
+//ExportOutputsToEnv ... sets an environment variable named prefix+key for every stack output and returns
+//the names that were set. Note it mutates the environment of the whole process.
+func (s *Stack) ExportOutputsToEnv(prefix string) ([]string, error) {
+	outputs, err := s.ReadOutputs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(outputs))
+	for key, value := range outputs {
+		if err := os.Setenv(prefix+key, value); err != nil {
+			return names, s.wrapError("ExportOutputsToEnv", err)
+		}
+		names = append(names, prefix+key)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//DiffStackOutputs ... returns the outputs that differ between two stacks with their [stackA, stackB] values,
+//an output present in only one stack has an empty value for the other
+func DiffStackOutputs(region, stackA, stackB string) (map[string][2]string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return diffStackOutputs(cloudformation.New(sess), stackA, stackB)
+}
+func diffStackOutputs(svc cloudformationiface.CloudFormationAPI, stackA, stackB string) (map[string][2]string, error) {
+	a := NewStack(svc, stackA, "", nil)
+	outputsA, err := a.ReadOutputs()
+	if err != nil {
+		return nil, err
+	}
+	b := NewStack(svc, stackB, "", nil)
+	outputsB, err := b.ReadOutputs()
+	if err != nil {
+		return nil, err
+	}
+	return diffParameters(outputsA, outputsB), nil
+}
+
+//StatusReason ... returns the reason of the stack's last status and refreshes Status
+func (s *Stack) StatusReason() (string, error) {
+	if s.cfn == nil {
+		return "", fmt.Errorf(messageClientNotDefined)
+	}
+	input := cloudformation.DescribeStacksInput{StackName: &s.Name}
+	res, err := s.client().DescribeStacks(&input)
+	if err != nil {
+		return "", s.wrapError("StatusReason", err)
+	}
+	if len(res.Stacks) == 0 {
+		return "", s.wrapError("StatusReason", fmt.Errorf("Stack %s not found", s.Name))
+	}
+	s.Status = res.Stacks[0].StackStatus
+	return aws.StringValue(res.Stacks[0].StackStatusReason), nil
+}
+
+//WaitUntilSettled ... polls the stack until it is no longer in progress and returns its final status,
+//failed states are not reported as errors. REVIEW_IN_PROGRESS counts as settled, the stack stays in it
+//until its change set is executed
+func (s *Stack) WaitUntilSettled(ctx context.Context) (string, error) {
+	if s.cfn == nil {
+		return "", fmt.Errorf(messageClientNotDefined)
+	}
+	input := cloudformation.DescribeStacksInput{StackName: &s.Name}
+	for {
+		res, err := s.client().DescribeStacksWithContext(ctx, &input)
+		if err != nil {
+			return "", s.wrapError("WaitUntilSettled", err)
+		}
+		if len(res.Stacks) == 0 {
+			return "", s.wrapError("WaitUntilSettled", fmt.Errorf("Stack %s not found", s.Name))
+		}
+		s.Status = res.Stacks[0].StackStatus
+		status := aws.StringValue(s.Status)
+		if !strings.HasSuffix(status, "_IN_PROGRESS") || status == cloudformation.StackStatusReviewInProgress {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", s.wrapError("WaitUntilSettled", ctx.Err())
+		case <-time.After(stackPollInterval):
+		}
+	}
+}
+
+//WaitForRollback ... waits until a rolling back stack settles, an error is returned unless it ends
+//in UPDATE_ROLLBACK_COMPLETE or ROLLBACK_COMPLETE
+func (s *Stack) WaitForRollback(ctx context.Context) error {
+	status, err := s.WaitUntilSettled(ctx)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case cloudformation.StackStatusUpdateRollbackComplete, cloudformation.StackStatusRollbackComplete:
+		return nil
+	}
+	return s.wrapError("WaitForRollback", fmt.Errorf("Rollback finished with status %s", status))
+}
+
+//WaitForImport ... waits until a resource import settles, an error is returned unless it ends in IMPORT_COMPLETE
+func (s *Stack) WaitForImport(ctx context.Context) error {
+	status, err := s.WaitUntilSettled(ctx)
+	if err != nil {
+		return err
+	}
+	if status == cloudformation.StackStatusImportComplete {
+		return nil
+	}
+	return s.wrapError("WaitForImport", fmt.Errorf("Import finished with status %s", status))
+}
+
+//StreamEvents ... polls the stack events and sends the ones of the operation in progress, oldest first, until
+//that operation settles or the context is done. When the stack is already settled streaming stops right away,
+//unless StreamNextOperation is set. Both channels are closed when streaming stops.
+func (s *Stack) StreamEvents(ctx context.Context) (<-chan *cloudformation.StackEvent, <-chan error) {
+	events := make(chan *cloudformation.StackEvent)
+	errs := make(chan error, 1)
+	if s.cfn == nil {
+		errs <- fmt.Errorf(messageClientNotDefined)
+		close(events)
+		close(errs)
+		return events, errs
+	}
+
+	go func() {
+		defer close(events)
+		defer close(errs)
+		seen := make(map[string]bool)
+		for polls := 0; ; polls++ {
+			newEvents, err := s.newStackEvents(ctx, seen, polls == 0)
+			if err != nil {
+				errs <- s.wrapError("StreamEvents", err)
+				return
+			}
+			if polls == 0 && len(newEvents) == 0 && !s.StreamNextOperation {
+				return
+			}
+			for i := len(newEvents) - 1; i >= 0; i-- {
+				select {
+				case events <- newEvents[i]:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+				if s.isSettledEvent(newEvents[i]) {
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			case <-time.After(stackPollInterval):
+			}
+		}
+	}()
+	return events, errs
+}
+
+// newStackEvents returns the events not seen yet, newest first, and marks them as seen. The pages are read
+// until an event already seen or, on the first poll, until the last time the stack settled.
+func (s *Stack) newStackEvents(ctx context.Context, seen map[string]bool, first bool) ([]*cloudformation.StackEvent, error) {
+	newEvents := make([]*cloudformation.StackEvent, 0)
+	input := &cloudformation.DescribeStackEventsInput{StackName: aws.String(s.Name)}
+	for {
+		resp, err := s.client().DescribeStackEventsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range resp.StackEvents {
+			id := aws.StringValue(event.EventId)
+			if seen[id] {
+				return newEvents, nil
+			}
+			seen[id] = true
+			if first && s.isSettledEvent(event) {
+				return newEvents, nil
+			}
+			newEvents = append(newEvents, event)
+		}
+		if resp.NextToken == nil {
+			return newEvents, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// isSettledEvent tells if the event reports the stack itself reaching a final status.
+func (s *Stack) isSettledEvent(event *cloudformation.StackEvent) bool {
+	status := aws.StringValue(event.ResourceStatus)
+	// as in WaitUntilSettled, a stack in review waits for its change set to be executed
+	return aws.StringValue(event.ResourceType) == "AWS::CloudFormation::Stack" &&
+		aws.StringValue(event.LogicalResourceId) == s.Name &&
+		(!strings.HasSuffix(status, "_IN_PROGRESS") || status == cloudformation.StackStatusReviewInProgress)
+}
+
+//WriteEvents ... writes the events of StreamEvents to out, one line per event with the timestamp, logical
+//resource id, status and status reason, until the operation in progress settles or the context is done.
+//It returns right away when the stack is settled, unless StreamNextOperation is set
+func (s *Stack) WriteEvents(ctx context.Context, out io.Writer) error {
+	// stops the stream when out fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events, errs := s.StreamEvents(ctx)
+	for event := range events {
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\n",
+			aws.TimeValue(event.Timestamp).UTC().Format(time.RFC3339),
+			aws.StringValue(event.LogicalResourceId),
+			aws.StringValue(event.ResourceStatus),
+			aws.StringValue(event.ResourceStatusReason))
+		if _, err := io.WriteString(out, line); err != nil {
+			return err
+		}
+	}
+	return <-errs
+}
+
+//DeleteStack ... deletes the stack and waits for the deletion to complete. AWS errors are returned as is,
+//so a stack that does not exist can be detected from its ValidationError code
+func (s *Stack) DeleteStack() error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	if _, err := s.client().DeleteStack(&cloudformation.DeleteStackInput{StackName: aws.String(s.Name), ClientRequestToken: s.requestToken("DeleteStack", s.Name)}); err != nil {
+		return err
+	}
+	return s.client().WaitUntilStackDeleteComplete(&cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)})
+}
+
+//DeleteRetaining ... deletes the stack keeping the given resources, CloudFormation only accepts
+//retained resources for stacks in DELETE_FAILED state
+func (s *Stack) DeleteRetaining(logicalIDs []string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	resources, err := s.client().DescribeStackResources(&cloudformation.DescribeStackResourcesInput{StackName: aws.String(s.Name)})
+	if err != nil {
+		return s.wrapError("DeleteRetaining", err)
+	}
+	physicalIDs := make(map[string]string)
+	for _, resource := range resources.StackResources {
+		physicalIDs[aws.StringValue(resource.LogicalResourceId)] = aws.StringValue(resource.PhysicalResourceId)
+	}
+	for _, logicalID := range logicalIDs {
+		physicalID, ok := physicalIDs[logicalID]
+		if !ok {
+			return s.wrapError("DeleteRetaining", fmt.Errorf("Resource %s not found in stack %s", logicalID, s.Name))
+		}
+		s.logEvent(LogEvent{Operation: "DeleteRetaining", Message: fmt.Sprintf("Retaining %s (%s)", logicalID, physicalID)})
+	}
+
+	input := &cloudformation.DeleteStackInput{
+		StackName:          aws.String(s.Name),
+		RetainResources:    aws.StringSlice(logicalIDs),
+		ClientRequestToken: s.requestToken("DeleteStack", s.Name),
+	}
+	if _, err := s.client().DeleteStack(input); err != nil {
+		return s.wrapError("DeleteRetaining", err)
+	}
+	desInput := &cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)}
+	return s.wrapError("DeleteRetaining", s.client().WaitUntilStackDeleteComplete(desInput))
+}
+
+//SetTerminationProtection ... enables or disables the termination protection of the stack,
+//DeleteStack fails while it is enabled
+func (s *Stack) SetTerminationProtection(enabled bool) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	input := &cloudformation.UpdateTerminationProtectionInput{
+		StackName:                   aws.String(s.Name),
+		EnableTerminationProtection: aws.Bool(enabled),
+	}
+	if _, err := s.client().UpdateTerminationProtection(input); err != nil {
+		return s.wrapError("SetTerminationProtection", err)
+	}
+	return nil
+}
+
+//ListChangeSets ... returns the change sets of the stack
+func (s *Stack) ListChangeSets() ([]*cloudformation.ChangeSetSummary, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	summaries := make([]*cloudformation.ChangeSetSummary, 0)
+	input := &cloudformation.ListChangeSetsInput{StackName: aws.String(s.Name)}
+	for {
+		resp, err := s.client().ListChangeSets(input)
+		if err != nil {
+			return nil, s.wrapError("ListChangeSets", err)
+		}
+		summaries = append(summaries, resp.Summaries...)
+		if resp.NextToken == nil {
+			return summaries, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+//ResourceIDMap ... returns the physical id of every resource of the stack keyed by logical id
+func (s *Stack) ResourceIDMap() (map[string]string, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	ids := make(map[string]string)
+	input := &cloudformation.ListStackResourcesInput{StackName: aws.String(s.Name)}
+	for {
+		resp, err := s.client().ListStackResources(input)
+		if err != nil {
+			return nil, s.wrapError("ResourceIDMap", err)
+		}
+		for _, resource := range resp.StackResourceSummaries {
+			ids[aws.StringValue(resource.LogicalResourceId)] = aws.StringValue(resource.PhysicalResourceId)
+		}
+		if resp.NextToken == nil {
+			return ids, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+//DeployLocalTemplate ... uploads a local template to a scratch bucket and creates or updates the stack with it
+func (s *Stack) DeployLocalTemplate(path, scratchBucket, region string, parameters map[string]string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return s.deployLocalTemplate(s3.New(sess), path, scratchBucket, region, parameters)
+}
+func (s *Stack) deployLocalTemplate(s3Client s3iface.S3API, path, scratchBucket, region string, parameters map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return s.wrapError("DeployLocalTemplate", err)
+	}
+	defer f.Close()
+
+	bucket := NewBucket(s3Client, scratchBucket, "")
+	bucket.MetricsHook = s.MetricsHook
+	key := s.Name + "/" + filepath.Base(path)
+	if _, err := bucket.client().PutObject(bucket.putObjectInput(key, f, false)); err != nil {
+		return s.wrapError("DeployLocalTemplate", err)
+	}
+	s.TemplateURL = S3TemplateURL(scratchBucket, key, region)
+	return s.CreateOrUpdate(parameters)
+}
+
+//GetParameters ... returns the current parameter values of the stack, NoEcho parameters are masked by
+//CloudFormation and are left out
+func (s *Stack) GetParameters() (map[string]string, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	input := cloudformation.DescribeStacksInput{StackName: &s.Name}
+	res, err := s.client().DescribeStacks(&input)
+	if err != nil {
+		return nil, s.wrapError("GetParameters", err)
+	}
+	parameters := make(map[string]string)
+	for _, stack := range res.Stacks {
+		for _, parameter := range stack.Parameters {
+			if aws.StringValue(parameter.ParameterValue) == redactedValue {
+				s.logEvent(LogEvent{Operation: "GetParameters", Message: "Skipping NoEcho parameter " + aws.StringValue(parameter.ParameterKey)})
+				continue
+			}
+			parameters[*parameter.ParameterKey] = aws.StringValue(parameter.ParameterValue)
+		}
+	}
+	return parameters, nil
+}
+
+//DiffParametersFile ... compares the parameters file with the parameters of the deployed stack and
+//returns the changed keys with their [deployed, file] values
+func (s *Stack) DiffParametersFile(fileName string) (map[string][2]string, error) {
+	desired, err := LoadParameters(fileName)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.GetParameters()
+	if err != nil {
+		return nil, err
+	}
+	return diffParameters(current, desired), nil
+}
+
+//StackDefinition ... what Export writes to recreate a stack
+type StackDefinition struct {
+	Name         string            `json:"name"`
+	TemplateBody string            `json:"templateBody"`
+	Parameters   map[string]string `json:"parameters"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+}
+
+//Export ... writes the template, parameters, tags and capabilities of the deployed stack to a JSON file.
+//NoEcho parameters are left out, CloudFormation only returns them masked.
+func (s *Stack) Export(path string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	res, err := s.client().DescribeStacks(&cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)})
+	if err != nil {
+		return s.wrapError("Export", err)
+	}
+	if len(res.Stacks) == 0 {
+		return s.wrapError("Export", fmt.Errorf("Stack %s not found", s.Name))
+	}
+	templateResp, err := s.client().GetTemplate(&cloudformation.GetTemplateInput{StackName: aws.String(s.Name)})
+	if err != nil {
+		return s.wrapError("Export", err)
+	}
+
+	stack := res.Stacks[0]
+	definition := StackDefinition{
+		Name:         s.Name,
+		TemplateBody: aws.StringValue(templateResp.TemplateBody),
+		Parameters:   make(map[string]string),
+		Capabilities: aws.StringValueSlice(stack.Capabilities),
+	}
+	for _, parameter := range stack.Parameters {
+		if aws.StringValue(parameter.ParameterValue) == redactedValue {
+			s.logEvent(LogEvent{Operation: "Export", Message: "Skipping NoEcho parameter " + aws.StringValue(parameter.ParameterKey)})
+			continue
+		}
+		definition.Parameters[aws.StringValue(parameter.ParameterKey)] = aws.StringValue(parameter.ParameterValue)
+	}
+	if len(stack.Tags) > 0 {
+		definition.Tags = make(map[string]string)
+		for _, tag := range stack.Tags {
+			definition.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	content, err := json.MarshalIndent(definition, "", "  ")
+	if err != nil {
+		return s.wrapError("Export", err)
+	}
+	// the parameters may hold credentials, keep the file private
+	return s.wrapError("Export", ioutil.WriteFile(path, content, 0600))
+}
+
+//ImportFromFile ... reads a file written by Export and returns the stack, to be created with the
+//returned parameters using CreateOrUpdate
+func ImportFromFile(client cloudformationiface.CloudFormationAPI, path string) (Stack, map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return Stack{}, nil, err
 	}
-	for _, stack := range res.Stacks {
-		for _, output := range stack.Outputs {
-			parameters[*output.OutputKey] = *output.OutputValue
-		}
+	definition := StackDefinition{}
+	if err := json.Unmarshal(content, &definition); err != nil {
+		return Stack{}, nil, fmt.Errorf("Invalid stack definition %s: %s", path, err)
 	}
-	return parameters, nil
+	if definition.Name == "" || definition.TemplateBody == "" {
+		return Stack{}, nil, fmt.Errorf("Invalid stack definition %s: name and templateBody are required", path)
+	}
+	stack := NewStack(client, definition.Name, "", definition.Capabilities)
+	stack.TemplateBody = definition.TemplateBody
+	stack.Tags = definition.Tags
+	return stack, definition.Parameters, nil
 }
 
 //LoadParameters ...
 func LoadParameters(fileName string) (map[string]string, error) {
-	parameters := make(map[string]string)
-
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -131,13 +1219,76 @@ func LoadParameters(fileName string) (map[string]string, error) {
 
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	return parseParameters(file)
+}
 
-	for scanner.Scan() {
-		words := strings.Split(scanner.Text(), "=")
-		key := words[0]
-		value := words[1]
-		parameters[key] = value
+//LoadParametersFromTemplate ... renders a text/template with data and parses the key=value lines it produces
+func LoadParametersFromTemplate(templatePath string, data interface{}) (map[string]string, error) {
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return parseParameters(&rendered)
+}
+
+//LoadParametersTOML ... loads the parameters from a flat TOML file, scalar values are converted to strings
+func LoadParametersTOML(fileName string) (map[string]string, error) {
+	values := make(map[string]interface{})
+	if _, err := toml.DecodeFile(fileName, &values); err != nil {
+		return nil, err
+	}
+	parameters := make(map[string]string, len(values))
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			parameters[key] = v
+		case int64, float64, bool:
+			parameters[key] = fmt.Sprint(v)
+		case time.Time:
+			parameters[key] = v.Format(time.RFC3339)
+		default:
+			return nil, fmt.Errorf("Unsupported value for %s: only strings, numbers, booleans and dates are allowed", key)
+		}
+	}
+	return parameters, nil
+}
+
+//LoadParametersEncrypted ... loads a KMS encrypted parameters file
+func LoadParametersEncrypted(region, fileName string) (map[string]string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return loadParametersEncrypted(kms.New(sess), fileName)
+}
+func loadParametersEncrypted(client kmsiface.KMSAPI, fileName string) (map[string]string, error) {
+	ciphertext, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Decrypt(&kms.DecryptInput{CiphertextBlob: ciphertext})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt %s: %s", fileName, err.Error())
+	}
+	return parseParameters(bytes.NewReader(resp.Plaintext))
+}
+func parseParameters(r io.Reader) (map[string]string, error) {
+	parameters := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words := strings.SplitN(line, "=", 2)
+		if len(words) != 2 {
+			return nil, fmt.Errorf("Invalid parameter at line %d, expected key=value: %s", lineNumber, line)
+		}
+		parameters[strings.TrimSpace(words[0])] = strings.TrimSpace(words[1])
 	}
 	return parameters, scanner.Err()
 }
@@ -156,13 +1307,29 @@ func LoadEnvironmentVariables() (map[string]string, error) {
 	return parameters, nil
 }
 
-//GetAllStacksBy ...
+//GetAllStacksBy ... lists the stacks of the region that are not deleted, the returned stacks share a client
 func GetAllStacksBy(region string) ([]Stack, error) {
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(region),
 	}))
-	svc := cloudformation.New(sess)
+	return getAllStacksBy(cloudformation.New(sess))
+}
 
+//GetStacksLimited ... same as GetAllStacksBy but stops listing once max stacks are collected, 0 or less
+//returns all of them
+func GetStacksLimited(region string, max int) ([]Stack, error) {
+	if max <= 0 {
+		return GetAllStacksBy(region)
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return getStacksLimited(cloudformation.New(sess), max)
+}
+func getAllStacksBy(svc cloudformationiface.CloudFormationAPI) ([]Stack, error) {
+	return getStacksLimited(svc, 0)
+}
+func getStacksLimited(svc cloudformationiface.CloudFormationAPI, max int) ([]Stack, error) {
 	var filter = []*string{
 		aws.String("CREATE_IN_PROGRESS"),
 		aws.String("CREATE_FAILED"),
@@ -183,102 +1350,739 @@ func GetAllStacksBy(region string) ([]Stack, error) {
 		aws.String("REVIEW_IN_PROGRESS")}
 	input := &cloudformation.ListStacksInput{StackStatusFilter: filter}
 
-	resp, err := svc.ListStacks(input)
-	if err != nil {
-		log.Println(err.Error())
-		return nil, err
+	results := make([]Stack, 0)
+	for {
+		resp, err := svc.ListStacks(input)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, err
+		}
+		for _, summary := range resp.StackSummaries {
+			results = append(results, Stack{cfn: svc, Name: *summary.StackName, StackID: aws.StringValue(summary.StackId), Status: summary.StackStatus})
+			if max > 0 && len(results) == max {
+				return results, nil
+			}
+		}
+		if resp.NextToken == nil {
+			return results, nil
+		}
+		input.NextToken = resp.NextToken
 	}
+}
 
-	results := make([]Stack, 0)
+//DeleteStaleStacks ... deletes the stacks whose name starts with prefix and that were created more than
+//olderThan ago, stacks with an operation in progress are skipped. Returns the names of the deleted stacks.
+func DeleteStaleStacks(region, prefix string, olderThan time.Duration) ([]string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return deleteStaleStacks(cloudformation.New(sess), prefix, olderThan)
+}
+func deleteStaleStacks(svc cloudformationiface.CloudFormationAPI, prefix string, olderThan time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-olderThan)
+	deleted := make([]string, 0)
+	input := &cloudformation.ListStacksInput{}
+	for {
+		resp, err := svc.ListStacks(input)
+		if err != nil {
+			return deleted, err
+		}
+		for _, summary := range resp.StackSummaries {
+			name := aws.StringValue(summary.StackName)
+			status := aws.StringValue(summary.StackStatus)
+			if !strings.HasPrefix(name, prefix) || !aws.TimeValue(summary.CreationTime).Before(cutoff) ||
+				status == cloudformation.StackStatusDeleteComplete || strings.HasSuffix(status, "_IN_PROGRESS") {
+				continue
+			}
+			if _, err := svc.DeleteStack(&cloudformation.DeleteStackInput{StackName: summary.StackName}); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, name)
+		}
+		if resp.NextToken == nil {
+			return deleted, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
 
-	for _, summary := range resp.StackSummaries {
-		results = append(results, Stack{Name: *summary.StackName, Status: summary.StackStatus})
+//DetectExportCycles ... returns the groups of stacks, among names, that import each other's exports in a cycle
+//and therefore cannot be deleted one after the other
+func DetectExportCycles(region string, names []string) ([][]string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return detectExportCycles(cloudformation.New(sess), names)
+}
+func detectExportCycles(svc cloudformationiface.CloudFormationAPI, names []string) ([][]string, error) {
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	// graph maps an importing stack to the stacks it imports from
+	graph := make(map[string][]string)
+	input := &cloudformation.ListExportsInput{}
+	for {
+		resp, err := svc.ListExports(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, export := range resp.Exports {
+			exporter := stackNameFromID(aws.StringValue(export.ExportingStackId))
+			if !selected[exporter] {
+				continue
+			}
+			importers, err := listImports(svc, aws.StringValue(export.Name))
+			if err != nil {
+				return nil, err
+			}
+			for _, importer := range importers {
+				if selected[importer] {
+					graph[importer] = append(graph[importer], exporter)
+				}
+			}
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		input.NextToken = resp.NextToken
+	}
+	return findCycles(names, graph), nil
+}
+
+//WaitForExport ... polls the exports of the region until exportName is available and returns its value,
+//an error is returned after timeout
+func WaitForExport(region, exportName string, timeout time.Duration) (string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return waitForExport(cloudformation.New(sess), exportName, timeout)
+}
+func waitForExport(svc cloudformationiface.CloudFormationAPI, exportName string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		value, found, err := findExport(svc, exportName)
+		if err != nil || found {
+			return value, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", fmt.Errorf("Export %s not available after %s", exportName, timeout)
+		}
+		// the last poll happens at the deadline, not a whole interval after it
+		if remaining > stackPollInterval {
+			remaining = stackPollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+func findExport(svc cloudformationiface.CloudFormationAPI, exportName string) (string, bool, error) {
+	input := &cloudformation.ListExportsInput{}
+	for {
+		resp, err := svc.ListExports(input)
+		if err != nil {
+			return "", false, err
+		}
+		for _, export := range resp.Exports {
+			if aws.StringValue(export.Name) == exportName {
+				return aws.StringValue(export.Value), true, nil
+			}
+		}
+		if resp.NextToken == nil {
+			return "", false, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+func listImports(svc cloudformationiface.CloudFormationAPI, exportName string) ([]string, error) {
+	importers := make([]string, 0)
+	input := &cloudformation.ListImportsInput{ExportName: aws.String(exportName)}
+	for {
+		resp, err := svc.ListImports(input)
+		if err != nil {
+			// an export nobody imports is reported as a validation error
+			if aerr, ok := err.(awserr.Error); ok && strings.Contains(aerr.Message(), "is not imported") {
+				return importers, nil
+			}
+			return nil, err
+		}
+		importers = append(importers, aws.StringValueSlice(resp.Imports)...)
+		if resp.NextToken == nil {
+			return importers, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// stackNameFromID extracts the name from a stack id (arn:aws:cloudformation:region:account:stack/name/guid).
+func stackNameFromID(stackID string) string {
+	parts := strings.Split(stackID, "/")
+	if len(parts) < 2 {
+		return stackID
+	}
+	return parts[1]
+}
+
+// findCycles returns the strongly connected components with more than one stack (or a self import).
+func findCycles(names []string, graph map[string][]string) [][]string {
+	index := make(map[string]int)
+	lowLink := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := make([]string, 0)
+	cycles := make([][]string, 0)
+
+	var visit func(name string)
+	visit = func(name string) {
+		index[name] = len(index)
+		lowLink[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+
+		selfLoop := false
+		for _, next := range graph[name] {
+			if next == name {
+				selfLoop = true
+			}
+			if _, visited := index[next]; !visited {
+				visit(next)
+				if lowLink[next] < lowLink[name] {
+					lowLink[name] = lowLink[next]
+				}
+			} else if onStack[next] && index[next] < lowLink[name] {
+				lowLink[name] = index[next]
+			}
+		}
+
+		if lowLink[name] == index[name] {
+			component := make([]string, 0)
+			for {
+				last := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[last] = false
+				component = append(component, last)
+				if last == name {
+					break
+				}
+			}
+			if len(component) > 1 || selfLoop {
+				sort.Strings(component)
+				cycles = append(cycles, component)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, visited := index[name]; !visited {
+			visit(name)
+		}
+	}
+	return cycles
+}
+
+//DeployAll ... deploys the stacks with CreateOrUpdate in waves, a stack is deployed after the stacks it depends on
+//(deps maps a stack name to the names it depends on) and the stacks of a wave are deployed in parallel.
+//The first failure cancels the rest of its wave and stops the deployment
+func DeployAll(stacks []*Stack, params map[string]map[string]string, deps map[string][]string) error {
+	byName := make(map[string]*Stack, len(stacks))
+	names := make([]string, 0, len(stacks))
+	for _, s := range stacks {
+		byName[s.Name] = s
+		names = append(names, s.Name)
+	}
+	waves, err := deployWaves(names, deps)
+	if err != nil {
+		return err
 	}
-	return results, nil
+	for _, wave := range waves {
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		var once sync.Once
+		var firstErr error
+		for _, name := range wave {
+			wg.Add(1)
+			go func(s *Stack) {
+				defer wg.Done()
+				if err := s.CreateOrUpdateWithContext(ctx, params[s.Name]); err != nil && !errors.Is(err, ErrNoChanges) {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}(byName[name])
+		}
+		wg.Wait()
+		cancel()
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+	return nil
+}
+
+// deployWaves groups names so that every stack comes in a later wave than its dependencies.
+func deployWaves(names []string, deps map[string][]string) ([][]string, error) {
+	pending := make(map[string]bool, len(names))
+	for _, name := range names {
+		pending[name] = true
+	}
+	for _, name := range names {
+		for _, dep := range deps[name] {
+			if !pending[dep] {
+				return nil, fmt.Errorf("Unknown dependency %s of stack %s", dep, name)
+			}
+		}
+	}
+	waves := make([][]string, 0)
+	for len(pending) > 0 {
+		wave := make([]string, 0)
+		for _, name := range names {
+			if !pending[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range deps[name] {
+				if pending[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, name)
+			}
+		}
+		if len(wave) == 0 {
+			return nil, fmt.Errorf("Dependency cycle between stacks: %v", findCycles(names, deps))
+		}
+		for _, name := range wave {
+			delete(pending, name)
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
 }
 
 //GetTeplateParameters ...
 func (s *Stack) GetTeplateParameters() (map[string]*string, error) {
+	return s.GetTeplateParametersWithContext(context.Background())
+}
+
+//GetTeplateParametersWithContext ... same as GetTeplateParameters with a context
+func (s *Stack) GetTeplateParametersWithContext(ctx context.Context) (map[string]*string, error) {
 	if s.cfn == nil {
 		return nil, fmt.Errorf(messageClientNotDefined)
 	}
-	return s.getTeplateParameters()
+	params, err := s.getTeplateParameters(ctx)
+	return params, s.wrapError("GetTeplateParameters", err)
 }
-func (s *Stack) getTeplateParameters() (map[string]*string, error) {
-
-	input := &cloudformation.ValidateTemplateInput{TemplateURL: &s.TemplateURL}
-	resp, err := s.cfn.ValidateTemplate(input)
+func (s *Stack) getTeplateParameters(ctx context.Context) (map[string]*string, error) {
+	resp, err := s.validateTemplate(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return templateParameters(resp), nil
+}
+func (s *Stack) validateTemplate(ctx context.Context) (*cloudformation.ValidateTemplateOutput, error) {
+	input := &cloudformation.ValidateTemplateInput{}
+	switch {
+	case s.TemplateBody != "":
+		input.TemplateBody = aws.String(s.TemplateBody)
+	case s.presigner != nil:
+		templateURL, err := s.presignTemplateURL()
+		if err != nil {
+			return nil, err
+		}
+		input.TemplateURL = aws.String(templateURL)
+	default:
+		input.TemplateURL = aws.String(s.TemplateURL)
+	}
+	return s.client().ValidateTemplateWithContext(ctx, input)
+}
+func templateParameters(resp *cloudformation.ValidateTemplateOutput) map[string]*string {
 	resultParameters := make(map[string]*string)
 	for _, tp := range resp.Parameters {
 		resultParameters[*tp.ParameterKey] = tp.DefaultValue
 	}
-	return resultParameters, nil
+	return resultParameters
+}
+
+//DetectCapabilities ... returns the capabilities the template requires, CAPABILITY_AUTO_EXPAND included when it
+//declares transforms. s.Capabilities is left as is, CreateOrUpdate uses the detected ones when it is empty
+func (s *Stack) DetectCapabilities() ([]string, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	resp, err := s.validateTemplate(context.Background())
+	if err != nil {
+		return nil, s.wrapError("DetectCapabilities", err)
+	}
+	return detectCapabilities(resp), nil
+}
+func detectCapabilities(resp *cloudformation.ValidateTemplateOutput) []string {
+	capabilities := aws.StringValueSlice(resp.Capabilities)
+	if len(resp.DeclaredTransforms) > 0 {
+		capabilities = append(capabilities, cloudformation.CapabilityCapabilityAutoExpand)
+	}
+	return capabilities
+}
+
+// ssmParameterTypePrefix starts the type of the template parameters whose value is the name of an SSM parameter.
+const ssmParameterTypePrefix = "AWS::SSM::Parameter::Value<"
+
+//FindMissingSSMParameters ... returns the SSM parameters referenced by the AWS::SSM::Parameter::Value
+//template parameters (given value or template default) that do not exist in the region
+func (s *Stack) FindMissingSSMParameters(region string, parameters map[string]string) ([]string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return s.findMissingSSMParameters(ssm.New(sess), parameters)
+}
+func (s *Stack) findMissingSSMParameters(ssmClient ssmiface.SSMAPI, parameters map[string]string) ([]string, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	resp, err := s.client().GetTemplateSummary(s.templateSummaryInput())
+	if err != nil {
+		return nil, s.wrapError("FindMissingSSMParameters", err)
+	}
+	names := make([]string, 0)
+	for _, declaration := range resp.Parameters {
+		if !strings.HasPrefix(aws.StringValue(declaration.ParameterType), ssmParameterTypePrefix) {
+			continue
+		}
+		name, ok := parameters[aws.StringValue(declaration.ParameterKey)]
+		if !ok {
+			name = aws.StringValue(declaration.DefaultValue)
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	missing := make([]string, 0)
+	// GetParameters accepts at most 10 names per call
+	for start := 0; start < len(names); start += 10 {
+		end := start + 10
+		if end > len(names) {
+			end = len(names)
+		}
+		out, err := ssmClient.GetParameters(&ssm.GetParametersInput{Names: aws.StringSlice(names[start:end])})
+		if err != nil {
+			return nil, s.wrapError("FindMissingSSMParameters", err)
+		}
+		missing = append(missing, aws.StringValueSlice(out.InvalidParameters)...)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+//PresignTemplate ... makes the template be validated through a short lived presigned URL created with
+//client, so templates in private buckets can be validated
+func (s *Stack) PresignTemplate(client s3iface.S3API) {
+	s.presigner = client
+}
+func (s *Stack) presignTemplateURL() (string, error) {
+	bucket, key, err := parseS3TemplateURL(s.TemplateURL)
+	if err != nil {
+		return "", err
+	}
+	req, _ := s.presigner.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	return req.Presign(templatePresignExpiry)
 }
 
 //CreateStack ...
 func (s *Stack) CreateStack(parameters map[string]string) error {
+	return s.CreateStackWithContext(context.Background(), parameters)
+}
+
+//CreateStackWithContext ... same as CreateStack, stops waiting when the context is done
+func (s *Stack) CreateStackWithContext(ctx context.Context, parameters map[string]string) error {
 	if s.cfn == nil {
 		return fmt.Errorf(messageClientNotDefined)
 	}
 	cfnParameters := convertToCfnParameter(parameters)
-	return s.createStack(cfnParameters)
+	_, err := s.createStack(ctx, cfnParameters, s.Capabilities)
+	return s.wrapError("CreateStack", err)
 }
-func (s *Stack) createStack(parameters []*cloudformation.Parameter) error {
+
+// createStack creates the stack and waits for it, the returned id is empty when CloudFormation did not
+// accept the creation.
+func (s *Stack) createStack(ctx context.Context, parameters []*cloudformation.Parameter, capabilities []string) (string, error) {
+	if err := s.validateOnFailure(); err != nil {
+		return "", err
+	}
 	input := &cloudformation.CreateStackInput{
-		TemplateURL:  aws.String(s.TemplateURL),
-		StackName:    aws.String(s.Name),
-		Capabilities: aws.StringSlice(s.Capabilities),
-		Parameters:   parameters}
+		StackName:          aws.String(s.Name),
+		Capabilities:       aws.StringSlice(capabilities),
+		Parameters:         parameters,
+		ClientRequestToken: s.requestToken("CreateStack", s.replacedStackID)}
+	if s.TemplateBody != "" {
+		input.TemplateBody = aws.String(s.TemplateBody)
+	} else {
+		input.TemplateURL = aws.String(s.TemplateURL)
+	}
+	if len(s.Tags) > 0 {
+		input.Tags = convertToCfnTags(s.Tags)
+	}
+	if len(s.NotificationARNs) > 0 {
+		input.NotificationARNs = aws.StringSlice(s.NotificationARNs)
+	}
+	if s.RoleARN != "" {
+		input.RoleARN = aws.String(s.RoleARN)
+	}
+	if s.OnFailure != "" {
+		input.OnFailure = aws.String(s.OnFailure)
+	}
+	if s.DisableRollback {
+		input.DisableRollback = aws.Bool(true)
+	}
+	if s.TimeoutInMinutes > 0 {
+		input.TimeoutInMinutes = aws.Int64(s.TimeoutInMinutes)
+	}
+	if s.EnableTerminationProtection {
+		input.EnableTerminationProtection = aws.Bool(true)
+	}
 
-	_, err := s.cfn.CreateStack(input)
+	resp, err := s.client().CreateStackWithContext(ctx, input)
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		s.logEvent(LogEvent{Operation: "CreateStack", Status: logStatusFailed, Error: err.Error()})
+		return "", err
 	}
 
+	stackID := aws.StringValue(resp.StackId)
+	s.StackID = stackID
+
 	// Wait until stack is created
 	desInput := &cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)}
-	err = s.cfn.WaitUntilStackCreateComplete(desInput)
+	err = s.client().WaitUntilStackCreateCompleteWithContext(ctx, desInput)
 	if err != nil {
-		log.Println(err)
+		s.logEvent(LogEvent{Operation: "CreateStack", Status: logStatusFailed, Error: err.Error()})
+		return stackID, err
+	}
+	return stackID, nil
+}
+
+func (s *Stack) validateOnFailure() error {
+	if s.CleanupOnFailure && (s.DisableRollback || s.OnFailure == cloudformation.OnFailureDoNothing) {
+		return fmt.Errorf("CleanupOnFailure cannot be set with DisableRollback or OnFailure %s", cloudformation.OnFailureDoNothing)
+	}
+	if s.OnFailure == "" {
+		return nil
+	}
+	if s.DisableRollback {
+		return fmt.Errorf("OnFailure and DisableRollback cannot be both set")
+	}
+	for _, value := range cloudformation.OnFailure_Values() {
+		if s.OnFailure == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid OnFailure %s, expected one of [%s]", s.OnFailure, strings.Join(cloudformation.OnFailure_Values(), ","))
+}
+
+//CreateStackWithInterrupt ... creates the stack and, if the process receives an interrupt (Ctrl-C) before
+//the creation completes, deletes the partially created stack. The stack is kept when OnFailure is
+//DO_NOTHING or DisableRollback is set.
+func (s *Stack) CreateStackWithInterrupt(parameters map[string]string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s.createStackOrCleanup(ctx, parameters)
+}
+func (s *Stack) createStackOrCleanup(ctx context.Context, parameters map[string]string) error {
+	stackID, err := s.createStack(ctx, convertToCfnParameter(parameters), s.Capabilities)
+	if err == nil || ctx.Err() == nil {
+		return s.wrapError("CreateStack", err)
+	}
+	// nothing to delete if CloudFormation never accepted the creation
+	if stackID == "" || s.OnFailure == cloudformation.OnFailureDoNothing || s.DisableRollback {
+		return ctx.Err()
+	}
+	s.logEvent(LogEvent{Operation: "DeleteStack", Status: cloudformation.StackStatusDeleteInProgress, Message: "Creation of " + s.Name + " cancelled, deleting the stack"})
+	if err := s.deleteStackByID(stackID); err != nil {
 		return err
 	}
-	return nil
+	return ctx.Err()
 }
 
 //CreateChangeSet ...
 func (s *Stack) CreateChangeSet(parameters map[string]string) error {
+	return s.CreateChangeSetWithContext(context.Background(), parameters)
+}
+
+//CreateChangeSetWithContext ... same as CreateChangeSet, stops waiting when the context is done
+func (s *Stack) CreateChangeSetWithContext(ctx context.Context, parameters map[string]string) error {
 	if s.cfn == nil {
 		return fmt.Errorf(messageClientNotDefined)
 	}
 	cfnParameters := convertToCfnParameter(parameters)
-	return s.createChangeSet(cfnParameters)
+	name, err := s.createChangeSet(ctx, cfnParameters, s.Capabilities)
+	if err == nil {
+		s.ChangeSetName = name
+	}
+	return s.wrapError("CreateChangeSet", err)
 }
-func (s *Stack) createChangeSet(parameters []*cloudformation.Parameter) error {
+func (s *Stack) createChangeSet(ctx context.Context, parameters []*cloudformation.Parameter, capabilities []string) (string, error) {
 
 	t := time.Now()
 	changeSetName := s.Name + "-" + t.Format("20060102030405")
 	input := &cloudformation.CreateChangeSetInput{
-		TemplateURL:   aws.String(s.TemplateURL),
 		StackName:     aws.String(s.Name),
 		ChangeSetName: aws.String(changeSetName),
-		Parameters:    parameters}
+		Capabilities:  aws.StringSlice(capabilities),
+		Parameters:    parameters,
+		ClientToken:   s.requestToken("CreateChangeSet", changeSetName)}
+	if s.TemplateBody != "" {
+		input.TemplateBody = aws.String(s.TemplateBody)
+	} else {
+		input.TemplateURL = aws.String(s.TemplateURL)
+	}
+	// an empty list would remove the tags of the stack
+	if len(s.Tags) > 0 {
+		input.Tags = convertToCfnTags(s.Tags)
+	}
+	if len(s.NotificationARNs) > 0 {
+		input.NotificationARNs = aws.StringSlice(s.NotificationARNs)
+	}
+	if s.RoleARN != "" {
+		input.RoleARN = aws.String(s.RoleARN)
+	}
 
-	_, err := s.cfn.CreateChangeSet(input)
+	_, err := s.client().CreateChangeSetWithContext(ctx, input)
 	if err != nil {
-		log.Println(err.Error())
-		return err
+		s.logEvent(LogEvent{Operation: "CreateChangeSet", Status: logStatusFailed, Error: err.Error()})
+		return "", err
 	}
 
-	// Wait until stack is created
+	// Wait until the change set is created
+	desInput := &cloudformation.DescribeChangeSetInput{StackName: aws.String(s.Name), ChangeSetName: aws.String(changeSetName)}
+	err = s.client().WaitUntilChangeSetCreateCompleteWithContext(ctx, desInput)
+	if err != nil {
+		if resp, descErr := s.client().DescribeChangeSetWithContext(ctx, desInput); descErr == nil && isNoChangesChangeSet(resp) {
+			s.logEvent(LogEvent{Operation: "CreateChangeSet", Status: cloudformation.ChangeSetStatusFailed, Message: fmt.Sprintf("Change set %s has no changes, deleting it", changeSetName)})
+			s.deleteChangeSet(ctx, changeSetName)
+			return "", ErrNoChanges
+		}
+		s.logEvent(LogEvent{Operation: "CreateChangeSet", Status: logStatusFailed, Error: err.Error()})
+		return "", err
+	}
+	return changeSetName, nil
+}
+
+//DescribeChangeSet ... returns the changes of a change set to review them before ExecuteChangeSet,
+//a change set without changes returns an empty slice
+func (s *Stack) DescribeChangeSet(changeSetName string) ([]*cloudformation.Change, error) {
+	return s.DescribeChangeSetWithContext(context.Background(), changeSetName)
+}
+
+//DescribeChangeSetWithContext ... same as DescribeChangeSet with a context
+func (s *Stack) DescribeChangeSetWithContext(ctx context.Context, changeSetName string) ([]*cloudformation.Change, error) {
+	if s.cfn == nil {
+		return nil, fmt.Errorf(messageClientNotDefined)
+	}
+	changes := make([]*cloudformation.Change, 0)
+	input := &cloudformation.DescribeChangeSetInput{
+		StackName:     aws.String(s.Name),
+		ChangeSetName: aws.String(changeSetName),
+	}
+	for {
+		resp, err := s.client().DescribeChangeSetWithContext(ctx, input)
+		if err != nil {
+			return nil, s.wrapError("DescribeChangeSet", err)
+		}
+		if isNoChangesChangeSet(resp) {
+			return changes, nil
+		}
+		changes = append(changes, resp.Changes...)
+		if resp.NextToken == nil {
+			return changes, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+//ExecuteChangeSet ... executes a change set of the stack and waits for the update to complete
+func (s *Stack) ExecuteChangeSet(changeSetName string) error {
+	return s.ExecuteChangeSetWithContext(context.Background(), changeSetName)
+}
+
+//ExecuteChangeSetWithContext ... same as ExecuteChangeSet, stops waiting when the context is done
+func (s *Stack) ExecuteChangeSetWithContext(ctx context.Context, changeSetName string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	_, err := s.executeChangeSet(ctx, changeSetName)
+	return s.wrapError("ExecuteChangeSet", err)
+}
+
+// executeChangeSet executes the change set and waits for the update, executed tells if CloudFormation
+// accepted the execution.
+func (s *Stack) executeChangeSet(ctx context.Context, changeSetName string) (executed bool, err error) {
+	input := &cloudformation.ExecuteChangeSetInput{
+		StackName:          aws.String(s.Name),
+		ChangeSetName:      aws.String(changeSetName),
+		ClientRequestToken: s.requestToken("ExecuteChangeSet", changeSetName),
+	}
+	if _, err := s.client().ExecuteChangeSetWithContext(ctx, input); err != nil {
+		s.logEvent(LogEvent{Operation: "ExecuteChangeSet", Status: logStatusFailed, Error: err.Error()})
+		return false, err
+	}
 	desInput := &cloudformation.DescribeStacksInput{StackName: aws.String(s.Name)}
-	err = s.cfn.WaitUntilStackCreateComplete(desInput)
+	if err := s.client().WaitUntilStackUpdateCompleteWithContext(ctx, desInput); err != nil {
+		s.logEvent(LogEvent{Operation: "ExecuteChangeSet", Status: logStatusFailed, Error: err.Error()})
+		return true, err
+	}
+	return true, nil
+}
+
+// deleteChangeSet deletes a change set that won't be executed, the error is only logged.
+func (s *Stack) deleteChangeSet(ctx context.Context, changeSetName string) {
+	deleteInput := &cloudformation.DeleteChangeSetInput{StackName: aws.String(s.Name), ChangeSetName: aws.String(changeSetName)}
+	if _, err := s.client().DeleteChangeSetWithContext(ctx, deleteInput); err != nil {
+		s.logEvent(LogEvent{Operation: "DeleteChangeSet", Status: logStatusFailed, Error: err.Error()})
+	}
+}
+
+// isNoChangesChangeSet tells if the change set failed only because there was nothing to change.
+func isNoChangesChangeSet(resp *cloudformation.DescribeChangeSetOutput) bool {
+	reason := aws.StringValue(resp.StatusReason)
+	return aws.StringValue(resp.Status) == cloudformation.ChangeSetStatusFailed &&
+		(strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed"))
+}
+
+//TemplateMatches ... compares the deployed template with a local file, ignoring whitespace and JSON key order
+func (s *Stack) TemplateMatches(localPath string) (bool, error) {
+	if s.cfn == nil {
+		return false, fmt.Errorf(messageClientNotDefined)
+	}
+	local, err := ioutil.ReadFile(localPath)
 	if err != nil {
-		log.Println(err)
-		return err
+		return false, s.wrapError("TemplateMatches", err)
 	}
-	return nil
+	input := &cloudformation.GetTemplateInput{StackName: aws.String(s.Name)}
+	resp, err := s.client().GetTemplate(input)
+	if err != nil {
+		return false, s.wrapError("TemplateMatches", err)
+	}
+	return templatesEqual(aws.StringValue(resp.TemplateBody), string(local)), nil
+}
+func templatesEqual(a, b string) bool {
+	var jsonA, jsonB interface{}
+	if json.Unmarshal([]byte(a), &jsonA) == nil && json.Unmarshal([]byte(b), &jsonB) == nil {
+		return reflect.DeepEqual(jsonA, jsonB)
+	}
+	return strings.Join(strings.Fields(a), "") == strings.Join(strings.Fields(b), "")
 }
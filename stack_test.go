@@ -2,37 +2,288 @@
 package awsutils
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 /*Mock stuff*/
 type mockedClient struct {
 	cloudformationiface.CloudFormationAPI
-	RespValidateTemplateOutput *cloudformation.ValidateTemplateOutput
+	RespValidateTemplateOutput       *cloudformation.ValidateTemplateOutput
+	RespTemplateSummaryOutput        *cloudformation.GetTemplateSummaryOutput
+	RespGetTemplateOutput            *cloudformation.GetTemplateOutput
+	RespDescribeStacksOutput         *cloudformation.DescribeStacksOutput
+	RespDescribeStackResourcesOutput *cloudformation.DescribeStackResourcesOutput
+	RespDescribeChangeSetOutput      *cloudformation.DescribeChangeSetOutput
+	DeleteStackInput                 *cloudformation.DeleteStackInput
+	ValidateTemplateInput            *cloudformation.ValidateTemplateInput
+	ExecuteChangeSetInput            *cloudformation.ExecuteChangeSetInput
+	// DescribeStacksErr is returned by DescribeStacks instead of the stack not found error
+	DescribeStacksErr          error
+	TerminationProtectionInput *cloudformation.UpdateTerminationProtectionInput
+	// StacksByName are returned by DescribeStacks before RespDescribeStacksOutput
+	StacksByName map[string]*cloudformation.Stack
+	// ChangeSetDescribePages are returned by DescribeChangeSet instead, keyed by NextToken ("" for the first page)
+	ChangeSetDescribePages map[string]*cloudformation.DescribeChangeSetOutput
+	// ResourcePages are returned by ListStackResources, keyed by NextToken ("" for the first page)
+	ResourcePages map[string]*cloudformation.ListStackResourcesOutput
+	// Exports are returned by ListExports and Imports by ListImports, keyed by export name
+	Exports []*cloudformation.Export
+	Imports map[string][]string
+	// EventPolls are returned one by one by DescribeStackEventsWithContext, the last one is repeated
+	EventPolls  [][]*cloudformation.StackEvent
+	eventsCalls int
+	eventsPoll  int
+	// EventPageSize splits the EventPolls in pages of that size when set
+	EventPageSize int
+	// StackPages are returned by ListStacks, keyed by NextToken ("" for the first page)
+	StackPages      map[string]*cloudformation.ListStacksOutput
+	listStacksCalls int
+	// DeleteStackErr is returned by DeleteStack when set
+	DeleteStackErr error
+	// DeletedStacks records the names passed to DeleteStack
+	DeletedStacks []string
+	// CreateStackInput and CreateChangeSetInput record the last inputs of the create calls
+	CreateStackInput     *cloudformation.CreateStackInput
+	CreateChangeSetInput *cloudformation.CreateChangeSetInput
+	// CreateChangeSetErrs are returned one by one by CreateChangeSet before it succeeds
+	CreateChangeSetErrs []error
+	// ExecuteChangeSetErrs are returned one by one by ExecuteChangeSet before it succeeds
+	ExecuteChangeSetErrs []error
+	// BlockCreate makes the create waiter block until its context is done
+	BlockCreate bool
+	// CreateWaitErr is returned by the create waiter when set
+	CreateWaitErr error
+	// CreateStackErr is returned by CreateStack and UpdateWaitErr by the update waiter when set
+	CreateStackErr error
+	UpdateWaitErr  error
+	// ChangeSetCalls records the change sets executed and deleted
+	ChangeSetCalls []string
+	// UpdatesCancelled counts the CancelUpdateStack calls
+	UpdatesCancelled int
+	// ChangeSetPages are returned by ListChangeSets, keyed by NextToken ("" for the first page)
+	ChangeSetPages map[string]*cloudformation.ListChangeSetsOutput
+	// Statuses are returned one by one by DescribeStacksWithContext, the last one is repeated
+	Statuses      []string
+	describeCalls int
 }
 
-func (m *mockedClient) ValidateTemplate(in *cloudformation.ValidateTemplateInput) (*cloudformation.ValidateTemplateOutput, error) {
+func (m *mockedClient) ValidateTemplateWithContext(ctx aws.Context, in *cloudformation.ValidateTemplateInput, opts ...request.Option) (*cloudformation.ValidateTemplateOutput, error) {
+	m.ValidateTemplateInput = in
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return m.RespValidateTemplateOutput, nil
 }
+func (m *mockedClient) GetTemplate(in *cloudformation.GetTemplateInput) (*cloudformation.GetTemplateOutput, error) {
+	return m.RespGetTemplateOutput, nil
+}
 func (m *mockedClient) DescribeStacks(in *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
-	return nil, fmt.Errorf("Not found error")
+	if stack, ok := m.StacksByName[aws.StringValue(in.StackName)]; ok {
+		return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{stack}}, nil
+	}
+	if m.RespDescribeStacksOutput != nil {
+		return m.RespDescribeStacksOutput, nil
+	}
+	if m.DescribeStacksErr != nil {
+		return nil, m.DescribeStacksErr
+	}
+	return nil, awserr.New("ValidationError", "Stack with id "+aws.StringValue(in.StackName)+" does not exist", nil)
+}
+func (m *mockedClient) DescribeStacksWithContext(ctx aws.Context, in *cloudformation.DescribeStacksInput, opts ...request.Option) (*cloudformation.DescribeStacksOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(m.Statuses) == 0 {
+		return m.DescribeStacks(in)
+	}
+	i := m.describeCalls
+	if i >= len(m.Statuses) {
+		i = len(m.Statuses) - 1
+	}
+	m.describeCalls++
+	return &cloudformation.DescribeStacksOutput{
+		Stacks: []*cloudformation.Stack{&cloudformation.Stack{StackName: in.StackName, StackStatus: aws.String(m.Statuses[i])}},
+	}, nil
+}
+func (m *mockedClient) DescribeStackResources(in *cloudformation.DescribeStackResourcesInput) (*cloudformation.DescribeStackResourcesOutput, error) {
+	return m.RespDescribeStackResourcesOutput, nil
+}
+func (m *mockedClient) DeleteStack(in *cloudformation.DeleteStackInput) (*cloudformation.DeleteStackOutput, error) {
+	m.DeleteStackInput = in
+	if m.DeleteStackErr != nil {
+		return nil, m.DeleteStackErr
+	}
+	m.DeletedStacks = append(m.DeletedStacks, *in.StackName)
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+func (m *mockedClient) WaitUntilStackDeleteComplete(in *cloudformation.DescribeStacksInput) error {
+	return nil
+}
+func (m *mockedClient) ListStackResources(in *cloudformation.ListStackResourcesInput) (*cloudformation.ListStackResourcesOutput, error) {
+	return m.ResourcePages[aws.StringValue(in.NextToken)], nil
+}
+func (m *mockedClient) ListExports(in *cloudformation.ListExportsInput) (*cloudformation.ListExportsOutput, error) {
+	return &cloudformation.ListExportsOutput{Exports: m.Exports}, nil
+}
+func (m *mockedClient) ListImports(in *cloudformation.ListImportsInput) (*cloudformation.ListImportsOutput, error) {
+	imports, ok := m.Imports[*in.ExportName]
+	if !ok {
+		return nil, awserr.New("ValidationError", "Export '"+*in.ExportName+"' is not imported by any stack.", nil)
+	}
+	return &cloudformation.ListImportsOutput{Imports: aws.StringSlice(imports)}, nil
+}
+func (m *mockedClient) DescribeStackEventsWithContext(ctx aws.Context, in *cloudformation.DescribeStackEventsInput, opts ...request.Option) (*cloudformation.DescribeStackEventsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := 0
+	if in.NextToken == nil {
+		m.eventsPoll = m.eventsCalls
+		if m.eventsPoll >= len(m.EventPolls) {
+			m.eventsPoll = len(m.EventPolls) - 1
+		}
+		m.eventsCalls++
+	} else {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	events := m.EventPolls[m.eventsPoll][start:]
+	out := &cloudformation.DescribeStackEventsOutput{StackEvents: events}
+	if m.EventPageSize > 0 && len(events) > m.EventPageSize {
+		out.StackEvents = events[:m.EventPageSize]
+		out.NextToken = aws.String(strconv.Itoa(start + m.EventPageSize))
+	}
+	return out, nil
+}
+func (m *mockedClient) GetTemplateSummary(in *cloudformation.GetTemplateSummaryInput) (*cloudformation.GetTemplateSummaryOutput, error) {
+	return m.RespTemplateSummaryOutput, nil
+}
+func (m *mockedClient) GetTemplateSummaryWithContext(ctx aws.Context, in *cloudformation.GetTemplateSummaryInput, opts ...request.Option) (*cloudformation.GetTemplateSummaryOutput, error) {
+	if m.RespTemplateSummaryOutput == nil {
+		return nil, fmt.Errorf("Not found error")
+	}
+	return m.RespTemplateSummaryOutput, nil
+}
+func (m *mockedClient) ListStacks(in *cloudformation.ListStacksInput) (*cloudformation.ListStacksOutput, error) {
+	m.listStacksCalls++
+	page := m.StackPages[aws.StringValue(in.NextToken)]
+	if len(in.StackStatusFilter) == 0 {
+		return page, nil
+	}
+	allowed := make(map[string]bool)
+	for _, status := range in.StackStatusFilter {
+		allowed[*status] = true
+	}
+	filtered := &cloudformation.ListStacksOutput{NextToken: page.NextToken}
+	for _, summary := range page.StackSummaries {
+		if allowed[*summary.StackStatus] {
+			filtered.StackSummaries = append(filtered.StackSummaries, summary)
+		}
+	}
+	return filtered, nil
+}
+func (m *mockedClient) ListChangeSets(in *cloudformation.ListChangeSetsInput) (*cloudformation.ListChangeSetsOutput, error) {
+	return m.ChangeSetPages[aws.StringValue(in.NextToken)], nil
+}
+func (m *mockedClient) CreateStackWithContext(ctx aws.Context, in *cloudformation.CreateStackInput, opts ...request.Option) (*cloudformation.CreateStackOutput, error) {
+	m.CreateStackInput = in
+	if m.CreateStackErr != nil {
+		return nil, m.CreateStackErr
+	}
+	return &cloudformation.CreateStackOutput{StackId: aws.String("arn:aws:cloudformation:us-east-1:111111111111:stack/" + *in.StackName + "/guid")}, nil
 }
-func (m *mockedClient) CreateStack(in *cloudformation.CreateStackInput) (*cloudformation.CreateStackOutput, error) {
-	return &cloudformation.CreateStackOutput{}, nil
+func (m *mockedClient) WaitUntilStackCreateCompleteWithContext(ctx aws.Context, in *cloudformation.DescribeStacksInput, opts ...request.WaiterOption) error {
+	if m.BlockCreate {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if m.CreateWaitErr != nil {
+		return m.CreateWaitErr
+	}
+	return nil
 }
-func (m *mockedClient) CreateChangeSet(in *cloudformation.CreateChangeSetInput) (*cloudformation.CreateChangeSetOutput, error) {
+func (m *mockedClient) CreateChangeSetWithContext(ctx aws.Context, in *cloudformation.CreateChangeSetInput, opts ...request.Option) (*cloudformation.CreateChangeSetOutput, error) {
+	m.CreateChangeSetInput = in
+	if len(m.CreateChangeSetErrs) > 0 {
+		err := m.CreateChangeSetErrs[0]
+		m.CreateChangeSetErrs = m.CreateChangeSetErrs[1:]
+		return nil, err
+	}
 	return &cloudformation.CreateChangeSetOutput{}, nil
 }
-func (m *mockedClient) WaitUntilStackCreateComplete(in *cloudformation.DescribeStacksInput) error {
+func (m *mockedClient) WaitUntilChangeSetCreateCompleteWithContext(ctx aws.Context, in *cloudformation.DescribeChangeSetInput, opts ...request.WaiterOption) error {
+	if m.RespDescribeChangeSetOutput != nil && aws.StringValue(m.RespDescribeChangeSetOutput.Status) == cloudformation.ChangeSetStatusFailed {
+		return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", nil)
+	}
 	return nil
 }
+func (m *mockedClient) ExecuteChangeSetWithContext(ctx aws.Context, in *cloudformation.ExecuteChangeSetInput, opts ...request.Option) (*cloudformation.ExecuteChangeSetOutput, error) {
+	m.ChangeSetCalls = append(m.ChangeSetCalls, "Execute "+*in.ChangeSetName)
+	m.ExecuteChangeSetInput = in
+	if len(m.ExecuteChangeSetErrs) > 0 {
+		err := m.ExecuteChangeSetErrs[0]
+		m.ExecuteChangeSetErrs = m.ExecuteChangeSetErrs[1:]
+		return nil, err
+	}
+	return &cloudformation.ExecuteChangeSetOutput{}, nil
+}
+func (m *mockedClient) DeleteChangeSetWithContext(ctx aws.Context, in *cloudformation.DeleteChangeSetInput, opts ...request.Option) (*cloudformation.DeleteChangeSetOutput, error) {
+	m.ChangeSetCalls = append(m.ChangeSetCalls, "Delete "+*in.ChangeSetName)
+	return &cloudformation.DeleteChangeSetOutput{}, nil
+}
+func (m *mockedClient) WaitUntilStackUpdateCompleteWithContext(ctx aws.Context, in *cloudformation.DescribeStacksInput, opts ...request.WaiterOption) error {
+	return m.UpdateWaitErr
+}
+func (m *mockedClient) UpdateTerminationProtection(in *cloudformation.UpdateTerminationProtectionInput) (*cloudformation.UpdateTerminationProtectionOutput, error) {
+	m.TerminationProtectionInput = in
+	return &cloudformation.UpdateTerminationProtectionOutput{StackId: aws.String("id")}, nil
+}
+func (m *mockedClient) CancelUpdateStack(in *cloudformation.CancelUpdateStackInput) (*cloudformation.CancelUpdateStackOutput, error) {
+	m.UpdatesCancelled++
+	return &cloudformation.CancelUpdateStackOutput{}, nil
+}
+func (m *mockedClient) DescribeChangeSetWithContext(ctx aws.Context, in *cloudformation.DescribeChangeSetInput, opts ...request.Option) (*cloudformation.DescribeChangeSetOutput, error) {
+	if m.ChangeSetDescribePages != nil {
+		return m.ChangeSetDescribePages[aws.StringValue(in.NextToken)], nil
+	}
+	return m.RespDescribeChangeSetOutput, nil
+}
+
+type mockedKMSClient struct {
+	kmsiface.KMSAPI
+}
+
+func (m *mockedKMSClient) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if !bytes.HasPrefix(in.CiphertextBlob, []byte("encrypted:")) {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{Plaintext: bytes.TrimPrefix(in.CiphertextBlob, []byte("encrypted:"))}, nil
+}
 
 func generateParamers(n int) map[string]string {
 	parameters := make(map[string]string)
@@ -81,6 +332,38 @@ func TestFindMissingParametresFail(t *testing.T) {
 	}
 }
 
+func TestFindMissingParametresAlphabetical(t *testing.T) {
+	requiredParam := map[string]*string{"b": nil, "c": nil, "a": nil}
+	err := findMissingParametres(requiredParam, map[string]string{})
+	if err == nil || err.Error() != "Missing: [a,b,c]" {
+		t.Errorf("Expected: Missing: [a,b,c], and got: %v", err)
+	}
+}
+
+func TestCreateOrUpdateMissingInGroupOrder(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("Alpha")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("Subnet")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("Vpc")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("Env")}},
+		},
+		RespTemplateSummaryOutput: &cloudformation.GetTemplateSummaryOutput{
+			Metadata: aws.String(`{"AWS::CloudFormation::Interface": {"ParameterGroups": [
+				{"Label": {"default": "General"}, "Parameters": ["Env"]},
+				{"Label": {"default": "Network"}, "Parameters": ["Vpc", "Subnet"]}
+			]}}`),
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	err := s.CreateOrUpdate(map[string]string{})
+	if err == nil || !strings.HasSuffix(err.Error(), "Missing: [Env,Vpc,Subnet,Alpha]") {
+		t.Errorf("Expected missing parameters in group order, and got %v", err)
+	}
+}
+
 func TestConvertToCfnParameter(t *testing.T) {
 
 	parameters := map[string]string{
@@ -195,28 +478,2240 @@ func TestCreateChangeSet(t *testing.T) {
 
 }
 
-func TestCreateOrUpdate(t *testing.T) {
-	parameters := generateParamers(4)
-	// Forgot to define client
+func TestCreateChangeSetNoChanges(t *testing.T) {
+	mock := &mockedClient{
+		RespDescribeChangeSetOutput: &cloudformation.DescribeChangeSetOutput{
+			Status:       aws.String(cloudformation.ChangeSetStatusFailed),
+			StatusReason: aws.String("The submitted information didn't contain changes. Submit different information to create a change set."),
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	err := s.CreateChangeSet(generateParamers(1))
+	if !errors.Is(err, ErrNoChanges) {
+		t.Errorf("Expected error :%s, and got %v", ErrNoChanges, err)
+	}
+
+	// Other failures are reported as is
+	mock.RespDescribeChangeSetOutput.StatusReason = aws.String("Template error")
+	err = s.CreateChangeSet(generateParamers(1))
+	if err == nil || errors.Is(err, ErrNoChanges) {
+		t.Errorf("Expected the waiter error, and got %v", err)
+	}
+}
+
+func TestConvertToCfnTags(t *testing.T) {
+	if tags := convertToCfnTags(map[string]string{}); len(tags) != 0 {
+		t.Errorf("Expected no tags, and got %v", tags)
+	}
+	tags := convertToCfnTags(map[string]string{"CostCenter": "42", "Owner": "team"})
+	values := make(map[string]string)
+	for _, tag := range tags {
+		values[*tag.Key] = *tag.Value
+	}
+	if len(tags) != 2 || values["CostCenter"] != "42" || values["Owner"] != "team" {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+}
+
+func TestStackTags(t *testing.T) {
+	mock := &mockedClient{}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Tags = map[string]string{"CostCenter": "42"}
+	if err := s.CreateStack(generateParamers(1)); err != nil {
+		t.Errorf(err.Error())
+	}
+	if err := s.CreateChangeSet(generateParamers(1)); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.CreateStackInput.Tags) != 1 || len(mock.CreateChangeSetInput.Tags) != 1 {
+		t.Errorf("Expected the tags on the stack and the change set")
+	}
+
+	// Without tags the change set keeps the existing ones
+	s.Tags = nil
+	s.CreateChangeSet(generateParamers(1))
+	if mock.CreateChangeSetInput.Tags != nil {
+		t.Errorf("Expected no tags on the change set, and got %v", mock.CreateChangeSetInput.Tags)
+	}
+}
+
+func TestInitializeCfnWithConfig(t *testing.T) {
+	s := Stack{Name: "name"}
+	s.InitilizeCfn("eu-west-1")
+	client, ok := s.cfn.(*cloudformation.CloudFormation)
+	if !ok {
+		t.Fatalf("Expected a CloudFormation client")
+	}
+	if aws.StringValue(client.Config.Region) != "eu-west-1" {
+		t.Errorf("Expected region eu-west-1, and got %s", aws.StringValue(client.Config.Region))
+	}
+
+	s.InitializeCfnWithConfig(&aws.Config{Region: aws.String("us-east-1"), Endpoint: aws.String("http://localhost:4566")})
+	client = s.cfn.(*cloudformation.CloudFormation)
+	if client.Endpoint != "http://localhost:4566" {
+		t.Errorf("Expected the custom endpoint, and got %s", client.Endpoint)
+	}
+}
+
+func TestCreateOrUpdateResult(t *testing.T) {
 	sError := Stack{}
-	err := sError.CreateOrUpdate(parameters)
+	if _, err := sError.CreateOrUpdateResult(nil); err == nil || err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %v", messageClientNotDefined, err)
+	}
 
-	if err.Error() != messageClientNotDefined {
-		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	// New stack
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	result, err := s.CreateOrUpdateResult(map[string]string{})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := DeployResult{Action: DeployActionCreated, StackId: "arn:aws:cloudformation:us-east-1:111111111111:stack/name/guid"}
+	if result != expected || s.StackID != expected.StackId {
+		t.Errorf("Expected %v, and got %v", expected, result)
 	}
 
-	// Test success call
+	// Existing stack
+	mock.RespDescribeStacksOutput = &cloudformation.DescribeStacksOutput{
+		Stacks: []*cloudformation.Stack{{StackName: aws.String("name"), StackId: aws.String("existing-id")}},
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	result, err = s.CreateOrUpdateResult(map[string]string{})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if result.Action != DeployActionChangeSet || result.StackId != "existing-id" || !strings.HasPrefix(result.ChangeSetName, "name-") {
+		t.Errorf("Unexpected result: %v", result)
+	}
+}
+
+func TestUsePreviousValues(t *testing.T) {
+	// key3 and key4 are new in the template, only key4 has a default
 	mock := &mockedClient{
 		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
 			Parameters: []*cloudformation.TemplateParameter{
-				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")},
-				&cloudformation.TemplateParameter{ParameterKey: aws.String("key2")}},
+				{ParameterKey: aws.String("key1")},
+				{ParameterKey: aws.String("key2"), DefaultValue: aws.String("default")},
+				{ParameterKey: aws.String("key3")},
+				{ParameterKey: aws.String("key4"), DefaultValue: aws.String("default")}},
+		},
+		RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{{
+				StackName: aws.String("name"),
+				Parameters: []*cloudformation.Parameter{
+					{ParameterKey: aws.String("key1"), ParameterValue: aws.String("old")},
+					{ParameterKey: aws.String("key2"), ParameterValue: aws.String("deployed")}},
+			}},
 		},
 	}
 	s := NewStack(mock, "name", "url", []string{})
-	err = s.CreateOrUpdate(parameters)
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.UsePreviousValues = true
+	err := s.CreateOrUpdate(map[string]string{"key1": "new"})
+	if err == nil || !strings.Contains(err.Error(), "Missing: [key3]") {
+		t.Errorf("Expected missing key3, and got %v", err)
+	}
+
+	if err := s.CreateOrUpdate(map[string]string{"key1": "new", "key3": "value"}); err != nil {
+		t.Errorf(err.Error())
+	}
+	sent := make(map[string]string)
+	for _, parameter := range mock.CreateChangeSetInput.Parameters {
+		if aws.BoolValue(parameter.UsePreviousValue) {
+			sent[*parameter.ParameterKey] = "previous"
+		} else {
+			sent[*parameter.ParameterKey] = aws.StringValue(parameter.ParameterValue)
+		}
+	}
+	expected := map[string]string{"key1": "new", "key2": "previous", "key3": "value"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Expected %v, and got %v", expected, sent)
+	}
+
+	// A new stack still needs every parameter
+	mock.RespDescribeStacksOutput = nil
+	err = s.CreateOrUpdate(map[string]string{"key1": "new"})
+	if err == nil || !strings.Contains(err.Error(), "Missing: [key3]") {
+		t.Errorf("Expected missing key3, and got %v", err)
+	}
+}
+
+func TestRecreateFailedStacks(t *testing.T) {
+	failed := &cloudformation.DescribeStacksOutput{
+		Stacks: []*cloudformation.Stack{{StackName: aws.String("name"), StackStatus: aws.String(cloudformation.StackStatusRollbackComplete)}},
+	}
+
+	// Not enabled, a change set is attempted
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}, RespDescribeStacksOutput: failed}
+	s := NewStack(mock, "name", "url", []string{})
+	s.CreateOrUpdate(map[string]string{})
+	if len(mock.DeletedStacks) != 0 || mock.CreateChangeSetInput == nil {
+		t.Errorf("Expected a change set and no delete, and got %v", mock.DeletedStacks)
+	}
+
+	// Enabled, the stack is deleted and created again
+	mock = &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}, RespDescribeStacksOutput: failed}
+	var logs bytes.Buffer
+	s = NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(&logs, "", 0)
+	s.RecreateFailedStacks = true
+	result, err := s.CreateOrUpdateResult(map[string]string{})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.DeletedStacks) != 1 || mock.CreateStackInput == nil || mock.CreateChangeSetInput != nil || result.Action != DeployActionCreated {
+		t.Errorf("Expected the stack to be deleted and created, and got %v %v", mock.DeletedStacks, result)
+	}
+	if !strings.Contains(logs.String(), "Stack name is in ROLLBACK_COMPLETE, deleting it to create it again") {
+		t.Errorf("Expected the recreate to be logged, and got %q", logs.String())
+	}
+
+	// Delete fails
+	mock = &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}, RespDescribeStacksOutput: failed, DeleteStackErr: errors.New("AccessDenied")}
+	s = NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.RecreateFailedStacks = true
+	if err := s.CreateOrUpdate(map[string]string{}); err == nil || mock.CreateStackInput != nil {
+		t.Errorf("Expected the delete error and no create, and got %v", err)
+	}
+}
+
+func TestClientRequestToken(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	token := aws.StringValue(mock.CreateStackInput.ClientRequestToken)
+	if !strings.HasPrefix(token, "awsutils-CreateStack-") {
+		t.Errorf("Expected a generated token, and got %s", token)
+	}
+	// a retry from another process sends the same token
+	retry := NewStack(mock, "name", "url", []string{})
+	retry.CreateOrUpdate(map[string]string{})
+	if aws.StringValue(mock.CreateStackInput.ClientRequestToken) != token {
+		t.Errorf("Expected the token %s again, and got %s", token, *mock.CreateStackInput.ClientRequestToken)
+	}
+	// but a stack never sends the same token twice
+	s.CreateOrUpdate(map[string]string{})
+	if again := aws.StringValue(mock.CreateStackInput.ClientRequestToken); again == token {
+		t.Errorf("Expected a new token for a new creation, and got %s", again)
+	}
+	s.DeleteStack()
+	if deleteToken := aws.StringValue(mock.DeleteStackInput.ClientRequestToken); deleteToken == token || deleteToken == "" {
+		t.Errorf("Expected a different token to delete, and got %s", deleteToken)
+	}
+
+	// Change sets have tokens of their own
+	fresh := NewStack(mock, "name", "url", []string{})
+	other := NewStack(mock, "name", "url", []string{})
+	if *fresh.requestToken("CreateChangeSet", "name-1") == *other.requestToken("CreateChangeSet", "name-2") {
+		t.Errorf("Expected different tokens for different change sets")
+	}
+
+	// Creating again a failed stack doesn't reuse the token of its first creation
+	failed := &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{{
+		StackName:   aws.String("name"),
+		StackId:     aws.String("arn:aws:cloudformation:us-east-1:111111111111:stack/name/failed"),
+		StackStatus: aws.String(cloudformation.StackStatusRollbackComplete),
+	}}}
+	mock = &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}, RespDescribeStacksOutput: failed}
+	s = NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.RecreateFailedStacks = true
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if recreated := aws.StringValue(mock.CreateStackInput.ClientRequestToken); recreated == token {
+		t.Errorf("Expected a new token to create the stack again, and got %s", recreated)
+	}
+
+	// Explicit token
+	mock = &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}, RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{}}
+	s = NewStack(mock, "name", "url", []string{})
+	s.ClientRequestToken = "deploy-42"
+	s.AutoExecute = true
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if aws.StringValue(mock.CreateChangeSetInput.ClientToken) != "deploy-42-CreateChangeSet" || aws.StringValue(mock.ExecuteChangeSetInput.ClientRequestToken) != "deploy-42-ExecuteChangeSet" {
+		t.Errorf("Expected the explicit token, and got %s %s", aws.StringValue(mock.CreateChangeSetInput.ClientToken), aws.StringValue(mock.ExecuteChangeSetInput.ClientRequestToken))
+	}
+}
+
+func TestNotificationARNs(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	s.CreateOrUpdate(map[string]string{})
+	if mock.CreateStackInput.NotificationARNs != nil {
+		t.Errorf("Expected no notification ARNs, and got %v", mock.CreateStackInput.NotificationARNs)
+	}
+
+	topic := "arn:aws:sns:us-east-1:111111111111:ops"
+	s.NotificationARNs = []string{topic}
+	s.CreateOrUpdate(map[string]string{})
+	if arns := aws.StringValueSlice(mock.CreateStackInput.NotificationARNs); len(arns) != 1 || arns[0] != topic {
+		t.Errorf("Expected %s, and got %v", topic, arns)
+	}
+	mock.RespDescribeStacksOutput = &cloudformation.DescribeStacksOutput{}
+	s.CreateOrUpdate(map[string]string{})
+	if arns := aws.StringValueSlice(mock.CreateChangeSetInput.NotificationARNs); len(arns) != 1 || arns[0] != topic {
+		t.Errorf("Expected %s on the change set, and got %v", topic, arns)
+	}
+}
+
+func TestRoleARN(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	s.CreateOrUpdate(map[string]string{})
+	if mock.CreateStackInput.RoleARN != nil {
+		t.Errorf("Expected no role, and got %s", *mock.CreateStackInput.RoleARN)
+	}
+
+	role := "arn:aws:iam::111111111111:role/cfn-deploy"
+	s.RoleARN = role
+	s.CreateOrUpdate(map[string]string{})
+	if aws.StringValue(mock.CreateStackInput.RoleARN) != role {
+		t.Errorf("Expected %s, and got %v", role, mock.CreateStackInput.RoleARN)
+	}
+	mock.RespDescribeStacksOutput = &cloudformation.DescribeStacksOutput{}
+	s.CreateOrUpdate(map[string]string{})
+	if aws.StringValue(mock.CreateChangeSetInput.RoleARN) != role {
+		t.Errorf("Expected %s on the change set, and got %v", role, mock.CreateChangeSetInput.RoleARN)
+	}
+}
+
+func TestExists(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.Exists()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{}
+	s := NewStack(mock, "name", "url", []string{})
+	if exists, err := s.Exists(); exists || err != nil {
+		t.Errorf("Expected missing stack, and got %v %v", exists, err)
+	}
+	mock.RespDescribeStacksOutput = &cloudformation.DescribeStacksOutput{}
+	if exists, err := s.Exists(); !exists || err != nil {
+		t.Errorf("Expected existing stack, and got %v %v", exists, err)
+	}
+
+	// Other errors are not a missing stack
+	mock = &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		DescribeStacksErr:          awserr.New("Throttling", "Rate exceeded", nil),
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	if exists, err := s.Exists(); exists || err == nil || !strings.Contains(err.Error(), "Rate exceeded") {
+		t.Errorf("Expected throttling error, and got %v %v", exists, err)
+	}
+	err = s.CreateOrUpdate(map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "Rate exceeded") || mock.CreateStackInput != nil {
+		t.Errorf("Expected CreateOrUpdate to fail without creating the stack, and got %v", err)
+	}
+}
+
+func TestBusyRetries(t *testing.T) {
+	stackPollInterval = 0
+	busyRetryBackoff = 0
+	busy := awserr.New("ValidationError", "Stack:name is in UPDATE_IN_PROGRESS state and can not be updated.", nil)
+
+	// Without retries the error is returned
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		Statuses:                   []string{"UPDATE_IN_PROGRESS", "UPDATE_COMPLETE"},
+		CreateChangeSetErrs:        []error{busy},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.CreateOrUpdate(map[string]string{}); !isStackBusy(err) {
+		t.Errorf("Expected busy error, and got %v", err)
+	}
+
+	// The retry waits for the stack to settle and succeeds
+	mock = &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		Statuses:                   []string{"UPDATE_IN_PROGRESS", "UPDATE_IN_PROGRESS", "UPDATE_COMPLETE"},
+		CreateChangeSetErrs:        []error{busy},
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	s.BusyRetries = 2
+	result, err := s.CreateOrUpdateResult(map[string]string{})
 	if err != nil {
 		t.Errorf(err.Error())
 	}
+	if result.Action != DeployActionChangeSet || mock.CreateChangeSetInput == nil || len(mock.CreateChangeSetErrs) != 0 {
+		t.Errorf("Expected the change set to be created on retry, and got %v", result)
+	}
+	if mock.describeCalls < 3 {
+		t.Errorf("Expected to wait for the stack to settle, and got %d DescribeStacks calls", mock.describeCalls)
+	}
+
+	// Other errors and exhausted retries are not retried further
+	mock = &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		Statuses:                   []string{"UPDATE_COMPLETE"},
+		CreateChangeSetErrs:        []error{busy, busy, fmt.Errorf("denied")},
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	s.BusyRetries = 1
+	if err := s.CreateOrUpdate(map[string]string{}); !isStackBusy(err) || len(mock.CreateChangeSetErrs) != 1 {
+		t.Errorf("Expected busy error after one retry, and got %v", err)
+	}
+	s.BusyRetries = 5
+	if err := s.CreateOrUpdate(map[string]string{}); err == nil || !strings.Contains(err.Error(), "denied") || len(mock.CreateChangeSetErrs) != 0 {
+		t.Errorf("Expected denied error, and got %v", err)
+	}
+
+	// The change set that could not be executed is deleted before the retry creates another
+	mock = &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		Statuses:                   []string{"UPDATE_COMPLETE"},
+		ExecuteChangeSetErrs:       []error{busy},
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	s.AutoExecute = true
+	s.BusyRetries = 1
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.ChangeSetCalls) != 3 || !strings.HasPrefix(mock.ChangeSetCalls[0], "Execute ") || !strings.HasPrefix(mock.ChangeSetCalls[1], "Delete ") ||
+		!strings.HasPrefix(mock.ChangeSetCalls[2], "Execute ") {
+		t.Errorf("Expected execute, delete and execute again, and got %v", mock.ChangeSetCalls)
+	}
+}
+
+func TestBusyRetryBackoff(t *testing.T) {
+	backoff := 5 * time.Second
+	for i := 0; i < 10; i++ {
+		backoff = nextBusyRetryBackoff(backoff)
+	}
+	if backoff != busyRetryMaxBackoff {
+		t.Errorf("Expected the backoff to be capped at %s, and got %s", busyRetryMaxBackoff, backoff)
+	}
+	if backoff := nextBusyRetryBackoff(5 * time.Second); backoff != 10*time.Second {
+		t.Errorf("Expected 10s, and got %s", backoff)
+	}
+}
+
+func TestTimeoutInMinutes(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	s.CreateOrUpdate(map[string]string{})
+	if mock.CreateStackInput.TimeoutInMinutes != nil {
+		t.Errorf("Expected no timeout, and got %d", *mock.CreateStackInput.TimeoutInMinutes)
+	}
+
+	s.TimeoutInMinutes = 30
+	s.CreateOrUpdate(map[string]string{})
+	if aws.Int64Value(mock.CreateStackInput.TimeoutInMinutes) != 30 {
+		t.Errorf("Expected 30, and got %v", mock.CreateStackInput.TimeoutInMinutes)
+	}
+}
+
+func TestOnFailure(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	s.CreateOrUpdate(map[string]string{})
+	if mock.CreateStackInput.OnFailure != nil || mock.CreateStackInput.DisableRollback != nil {
+		t.Errorf("Expected the CloudFormation defaults, and got %v", mock.CreateStackInput)
+	}
+
+	s.OnFailure = cloudformation.OnFailureDoNothing
+	s.CreateOrUpdate(map[string]string{})
+	if aws.StringValue(mock.CreateStackInput.OnFailure) != "DO_NOTHING" {
+		t.Errorf("Expected DO_NOTHING, and got %v", mock.CreateStackInput.OnFailure)
+	}
+
+	s.OnFailure = ""
+	s.DisableRollback = true
+	s.CreateOrUpdate(map[string]string{})
+	if !aws.BoolValue(mock.CreateStackInput.DisableRollback) {
+		t.Errorf("Expected rollback to be disabled")
+	}
+
+	// Invalid combinations are rejected before creating the stack
+	mock.CreateStackInput = nil
+	s.OnFailure = cloudformation.OnFailureDelete
+	err := s.CreateOrUpdate(map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "cannot be both set") || mock.CreateStackInput != nil {
+		t.Errorf("Expected conflict error, and got %v", err)
+	}
+	s.DisableRollback = false
+	s.OnFailure = "KEEP"
+	err = s.CreateOrUpdate(map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "Invalid OnFailure KEEP") {
+		t.Errorf("Expected invalid value error, and got %v", err)
+	}
+
+	// A failed stack cannot be both kept and cleaned up
+	mock.CreateStackInput = nil
+	s.CleanupOnFailure = true
+	for _, keep := range []func(){
+		func() { s.OnFailure, s.DisableRollback = cloudformation.OnFailureDoNothing, false },
+		func() { s.OnFailure, s.DisableRollback = "", true },
+	} {
+		keep()
+		err = s.CreateOrUpdate(map[string]string{})
+		if err == nil || !strings.Contains(err.Error(), "CleanupOnFailure cannot be set") || mock.CreateStackInput != nil {
+			t.Errorf("Expected conflict error, and got %v", err)
+		}
+	}
+	s.OnFailure, s.DisableRollback = cloudformation.OnFailureDelete, false
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestExecuteChangeSet(t *testing.T) {
+	sError := Stack{}
+	err := sError.ExecuteChangeSet("cs")
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	// Review then execute
+	mock := &mockedClient{RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{}}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.CreateChangeSet(generateParamers(1)); err != nil {
+		t.Errorf(err.Error())
+	}
+	if !strings.HasPrefix(s.ChangeSetName, "name-") || len(mock.ChangeSetCalls) != 0 {
+		t.Errorf("Expected a change set to review, and got %s %v", s.ChangeSetName, mock.ChangeSetCalls)
+	}
+	if err := s.ExecuteChangeSet(s.ChangeSetName); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// Executed by CreateOrUpdate
+	mock.RespValidateTemplateOutput = &cloudformation.ValidateTemplateOutput{}
+	mock.ChangeSetCalls = nil
+	s.AutoExecute = true
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.ChangeSetCalls) != 1 || mock.ChangeSetCalls[0] != "Execute "+s.ChangeSetName {
+		t.Errorf("Expected the change set to be executed, and got %v", mock.ChangeSetCalls)
+	}
 
+	// Empty change sets are deleted
+	mock.ChangeSetCalls = nil
+	mock.RespDescribeChangeSetOutput = &cloudformation.DescribeChangeSetOutput{
+		Status:       aws.String(cloudformation.ChangeSetStatusFailed),
+		StatusReason: aws.String("No updates are to be performed."),
+	}
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err := s.CreateOrUpdate(map[string]string{}); !errors.Is(err, ErrNoChanges) {
+		t.Errorf("Expected error :%s, and got %v", ErrNoChanges, err)
+	}
+	if len(mock.ChangeSetCalls) != 1 || !strings.HasPrefix(mock.ChangeSetCalls[0], "Delete name-") {
+		t.Errorf("Expected the change set to be deleted, and got %v", mock.ChangeSetCalls)
+	}
+}
+
+func resourceChange(logicalID, action, replacement string) *cloudformation.Change {
+	return &cloudformation.Change{Type: aws.String(cloudformation.ChangeTypeResource), ResourceChange: &cloudformation.ResourceChange{
+		LogicalResourceId: aws.String(logicalID),
+		Action:            aws.String(action),
+		Replacement:       aws.String(replacement),
+	}}
+}
+
+func TestDescribeChangeSet(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.DescribeChangeSet("cs")
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{ChangeSetDescribePages: map[string]*cloudformation.DescribeChangeSetOutput{
+		"": {
+			Status:    aws.String(cloudformation.ChangeSetStatusCreateComplete),
+			Changes:   []*cloudformation.Change{resourceChange("Bucket", cloudformation.ChangeActionModify, cloudformation.ReplacementTrue)},
+			NextToken: aws.String("next"),
+		},
+		"next": {
+			Status:  aws.String(cloudformation.ChangeSetStatusCreateComplete),
+			Changes: []*cloudformation.Change{resourceChange("Queue", cloudformation.ChangeActionAdd, "")},
+		},
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+	changes, err := s.DescribeChangeSet("cs")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(changes) != 2 || *changes[0].ResourceChange.Replacement != cloudformation.ReplacementTrue || *changes[1].ResourceChange.Action != cloudformation.ChangeActionAdd {
+		t.Errorf("Unexpected changes: %v", changes)
+	}
+
+	// No updates
+	mock = &mockedClient{RespDescribeChangeSetOutput: &cloudformation.DescribeChangeSetOutput{
+		Status:       aws.String(cloudformation.ChangeSetStatusFailed),
+		StatusReason: aws.String("No updates are to be performed."),
+	}}
+	s = NewStack(mock, "name", "url", []string{})
+	changes, err = s.DescribeChangeSet("cs")
+	if err != nil || changes == nil || len(changes) != 0 {
+		t.Errorf("Expected no changes, and got %v %v", changes, err)
+	}
+}
+
+// mockedPresigner presigns with a real client and static credentials, which needs no network.
+type mockedPresigner struct {
+	s3iface.S3API
+	Presigned []string
+}
+
+func (m *mockedPresigner) GetObjectRequest(in *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	m.Presigned = append(m.Presigned, *in.Bucket+"/"+*in.Key)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+	return s3.New(sess).GetObjectRequest(in)
+}
+
+func TestPresignTemplate(t *testing.T) {
+	mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+	presigner := &mockedPresigner{}
+	s := NewStack(mock, "name", "https://bucket.s3.eu-west-1.amazonaws.com/dir/template.json", []string{})
+	s.PresignTemplate(presigner)
+	if _, err := s.GetTeplateParameters(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(presigner.Presigned) != 1 || presigner.Presigned[0] != "bucket/dir/template.json" {
+		t.Errorf("Expected the template to be presigned, and got %v", presigner.Presigned)
+	}
+	templateURL := *mock.ValidateTemplateInput.TemplateURL
+	if !strings.Contains(templateURL, "dir/template.json") || !strings.Contains(templateURL, "X-Amz-Signature=") {
+		t.Errorf("Expected a presigned URL, and got %s", templateURL)
+	}
+}
+
+func TestTemplateBody(t *testing.T) {
+	body := `{"Parameters": {"Env": {"Type": "String"}}, "Resources": {}}`
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{{ParameterKey: aws.String("Env")}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.TemplateBody = body
+	params, err := s.GetTeplateParameters()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if _, ok := params["Env"]; !ok {
+		t.Errorf("Expected the Env parameter, and got %v", params)
+	}
+	if aws.StringValue(mock.ValidateTemplateInput.TemplateBody) != body || mock.ValidateTemplateInput.TemplateURL != nil {
+		t.Errorf("Expected the template body to be validated, and got %v", mock.ValidateTemplateInput)
+	}
+
+	if err := s.CreateOrUpdate(map[string]string{"Env": "dev"}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if aws.StringValue(mock.CreateStackInput.TemplateBody) != body || mock.CreateStackInput.TemplateURL != nil {
+		t.Errorf("Expected the stack to be created from the template body, and got %v", mock.CreateStackInput)
+	}
+
+	// The constraints of a JSON body are checked before calling CloudFormation
+	mock.CreateStackInput = nil
+	s.TemplateBody = `{"Parameters": {"Env": {"Type": "String", "AllowedValues": ["dev", "prod"]}}, "Resources": {}}`
+	err = s.CreateOrUpdate(map[string]string{"Env": "test"})
+	if err == nil || !strings.Contains(err.Error(), "Env: AllowedValues [dev|prod]") || mock.CreateStackInput != nil {
+		t.Errorf("Expected AllowedValues violation before creating the stack, and got %v", err)
+	}
+
+	// YAML bodies are left to CloudFormation
+	s.TemplateBody = "Parameters:\n  Env:\n    Type: String\n    AllowedValues: [dev, prod]\n"
+	if err := s.CreateOrUpdate(map[string]string{"Env": "test"}); err != nil || mock.CreateStackInput == nil {
+		t.Errorf("Expected the YAML template to be sent, and got %v", err)
+	}
+}
+
+// deployRecorder records the order in which stacks sharing it are created.
+type deployRecorder struct {
+	*mockedClient
+	mu      *sync.Mutex
+	created *[]string
+}
+
+func (m deployRecorder) CreateStackWithContext(ctx aws.Context, in *cloudformation.CreateStackInput, opts ...request.Option) (*cloudformation.CreateStackOutput, error) {
+	m.mu.Lock()
+	*m.created = append(*m.created, *in.StackName)
+	m.mu.Unlock()
+	return m.mockedClient.CreateStackWithContext(ctx, in, opts...)
+}
+
+func TestDeployAll(t *testing.T) {
+	var mu sync.Mutex
+	var created []string
+	newStacks := func(failing, unchanged string) []*Stack {
+		stacks := make([]*Stack, 0)
+		for _, name := range []string{"app", "db", "network"} {
+			mock := &mockedClient{RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{}}
+			if name == failing {
+				mock.CreateWaitErr = errors.New("ResourceNotReady")
+			}
+			if name == unchanged {
+				mock.RespDescribeStacksOutput = &cloudformation.DescribeStacksOutput{}
+				mock.RespDescribeChangeSetOutput = &cloudformation.DescribeChangeSetOutput{
+					Status:       aws.String(cloudformation.ChangeSetStatusFailed),
+					StatusReason: aws.String("The submitted information didn't contain changes."),
+				}
+			}
+			s := NewStack(deployRecorder{mock, &mu, &created}, name, "url", []string{})
+			stacks = append(stacks, &s)
+		}
+		return stacks
+	}
+	deps := map[string][]string{"app": {"db", "network"}, "db": {"network"}}
+	params := map[string]map[string]string{"app": {"Env": "dev"}}
+
+	err := DeployAll(newStacks("", ""), params, deps)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(created, ",") != "network,db,app" {
+		t.Errorf("Unexpected deploy order: %v", created)
+	}
+
+	// A failure stops the stacks that depend on it
+	created = nil
+	err = DeployAll(newStacks("db", ""), params, deps)
+	if err == nil || !strings.Contains(err.Error(), "ResourceNotReady") {
+		t.Errorf("Expected the db failure, and got %v", err)
+	}
+	if strings.Join(created, ",") != "network,db" {
+		t.Errorf("Expected app not to be deployed, and got %v", created)
+	}
+
+	// A stack without changes doesn't stop the others
+	created = nil
+	err = DeployAll(newStacks("", "db"), params, deps)
+	if err != nil {
+		t.Errorf("Expected no error for an unchanged stack, and got %v", err)
+	}
+	if strings.Join(created, ",") != "network,app" {
+		t.Errorf("Expected network and app to be deployed, and got %v", created)
+	}
+
+	// Cycles and unknown stacks are rejected before deploying
+	created = nil
+	err = DeployAll(newStacks("", ""), params, map[string][]string{"db": {"app"}, "app": {"db"}})
+	if err == nil || !strings.Contains(err.Error(), "cycle") || len(created) != 0 {
+		t.Errorf("Expected cycle error, and got %v %v", err, created)
+	}
+	err = DeployAll(newStacks("", ""), params, map[string][]string{"app": {"cache"}})
+	if err == nil || !strings.Contains(err.Error(), "Unknown dependency cache") {
+		t.Errorf("Expected unknown dependency error, and got %v", err)
+	}
+}
+
+func TestDeployWaves(t *testing.T) {
+	waves, err := deployWaves([]string{"a", "b", "c", "d"}, map[string][]string{"c": {"a"}, "d": {"a", "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"a", "b"}, {"c"}, {"d"}}
+	if !reflect.DeepEqual(waves, expected) {
+		t.Errorf("Expected %v, and got %v", expected, waves)
+	}
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	sError := Stack{}
+	if _, err := sError.DetectCapabilities(); err == nil || err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %v", messageClientNotDefined, err)
+	}
+
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Capabilities:       aws.StringSlice([]string{cloudformation.CapabilityCapabilityNamedIam}),
+			DeclaredTransforms: aws.StringSlice([]string{"AWS::Serverless-2016-10-31"}),
+		},
+	}
+	s := NewStack(mock, "name", "url", nil)
+	capabilities, err := s.DetectCapabilities()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := []string{"CAPABILITY_NAMED_IAM", "CAPABILITY_AUTO_EXPAND"}
+	if !reflect.DeepEqual(capabilities, expected) || len(s.Capabilities) != 0 {
+		t.Errorf("Expected %v and the stack capabilities left empty, and got %v %v", expected, capabilities, s.Capabilities)
+	}
+
+	// CreateOrUpdate creates the stack with the detected capabilities, without keeping them
+	s = NewStack(mock, "name", "url", nil)
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if !reflect.DeepEqual(aws.StringValueSlice(mock.CreateStackInput.Capabilities), expected) || len(s.Capabilities) != 0 {
+		t.Errorf("Expected %v, and got %v %v", expected, mock.CreateStackInput.Capabilities, s.Capabilities)
+	}
+
+	// and the change set of an existing stack
+	mock.Statuses = []string{cloudformation.StackStatusUpdateComplete}
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if !reflect.DeepEqual(aws.StringValueSlice(mock.CreateChangeSetInput.Capabilities), expected) {
+		t.Errorf("Expected %v, and got %v", expected, mock.CreateChangeSetInput.Capabilities)
+	}
+
+	// Explicit capabilities win
+	s = NewStack(mock, "name", "url", []string{"CAPABILITY_IAM"})
+	if err := s.CreateOrUpdate(map[string]string{}); err != nil {
+		t.Errorf(err.Error())
+	}
+	if !reflect.DeepEqual(aws.StringValueSlice(mock.CreateChangeSetInput.Capabilities), []string{"CAPABILITY_IAM"}) {
+		t.Errorf("Expected the explicit capabilities, and got %v", mock.CreateChangeSetInput.Capabilities)
+	}
+}
+
+func TestCreateOrUpdate(t *testing.T) {
+	parameters := generateParamers(4)
+	// Forgot to define client
+	sError := Stack{}
+	err := sError.CreateOrUpdate(parameters)
+
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	// Test success call
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key2")}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	err = s.CreateOrUpdate(parameters)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+}
+
+func TestJSONLogger(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		CreateWaitErr:              errors.New("ResourceNotReady"),
+	}
+	var out bytes.Buffer
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = NewJSONLogger(&out)
+	s.CleanupOnFailure = true
+	s.CreateOrUpdate(map[string]string{})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, and got %q", out.String())
+	}
+	events := make([]LogEvent, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+			t.Fatalf("Invalid JSON %s: %s", line, err)
+		}
+		if events[i].Stack != "name" || events[i].Time.IsZero() {
+			t.Errorf("Expected stack and time, and got %v", events[i])
+		}
+	}
+	if events[0].Operation != "CreateStack" || events[0].Status != "FAILED" || events[0].Error != "ResourceNotReady" {
+		t.Errorf("Unexpected failure event: %v", events[0])
+	}
+	if events[1].Operation != "DeleteStack" || events[1].Status != cloudformation.StackStatusDeleteInProgress {
+		t.Errorf("Unexpected cleanup event: %v", events[1])
+	}
+
+	// Plain loggers keep getting text lines
+	var text bytes.Buffer
+	s.Logger = log.New(&text, "", 0)
+	s.CreateOrUpdate(map[string]string{})
+	if !strings.HasPrefix(text.String(), "ResourceNotReady\nCreation of name failed, deleting the stack\n") {
+		t.Errorf("Unexpected text log: %q", text.String())
+	}
+}
+
+func TestCleanupOnFailureCreate(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		CreateWaitErr:              errors.New("ResourceNotReady"),
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.CleanupOnFailure = true
+	err := s.CreateOrUpdate(map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "ResourceNotReady") {
+		t.Errorf("Expected the creation error, and got %v", err)
+	}
+	stackID := "arn:aws:cloudformation:us-east-1:111111111111:stack/name/guid"
+	if len(mock.DeletedStacks) != 1 || mock.DeletedStacks[0] != stackID {
+		t.Errorf("Expected the stack to be deleted by id, and got %v", mock.DeletedStacks)
+	}
+
+	// A creation CloudFormation refused is not cleaned up, the stack may be someone else's
+	mock = &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		CreateStackErr:             awserr.New(cloudformation.ErrCodeAlreadyExistsException, "Stack [name] already exists", nil),
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.CleanupOnFailure = true
+	if err := s.CreateOrUpdate(map[string]string{}); err == nil {
+		t.Errorf("Expected the creation error")
+	}
+	if len(mock.DeletedStacks) != 0 {
+		t.Errorf("Expected nothing deleted, and got %v", mock.DeletedStacks)
+	}
+}
+
+func TestCleanupOnFailureUpdate(t *testing.T) {
+	stackPollInterval = 0
+
+	// A change set that can't be created leaves the stack alone, the update in progress is not ours
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		Statuses:                   []string{cloudformation.StackStatusUpdateInProgress},
+		CreateChangeSetErrs:        []error{awserr.New("ValidationError", "Stack:name is in UPDATE_IN_PROGRESS state and can not be updated.", nil)},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.CleanupOnFailure = true
+	s.AutoExecute = true
+	if err := s.CreateOrUpdate(map[string]string{}); err == nil {
+		t.Errorf("Expected the change set error")
+	}
+	if mock.UpdatesCancelled != 0 {
+		t.Errorf("Expected no cancelled update, and got %d", mock.UpdatesCancelled)
+	}
+
+	// A failed update started by the change set is cancelled
+	mock = &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{},
+		UpdateWaitErr:              errors.New("ResourceNotReady"),
+		Statuses: []string{
+			cloudformation.StackStatusUpdateInProgress,
+			cloudformation.StackStatusUpdateInProgress,
+			cloudformation.StackStatusUpdateRollbackInProgress,
+			cloudformation.StackStatusUpdateRollbackComplete,
+		},
+	}
+	s = NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.CleanupOnFailure = true
+	s.AutoExecute = true
+	if err := s.CreateOrUpdate(map[string]string{}); err == nil {
+		t.Errorf("Expected the update error")
+	}
+	if mock.UpdatesCancelled != 1 || len(mock.DeletedStacks) != 0 {
+		t.Errorf("Expected the update to be cancelled and the stack kept, and got %d %v", mock.UpdatesCancelled, mock.DeletedStacks)
+	}
+	if aws.StringValue(s.Status) != cloudformation.StackStatusUpdateRollbackComplete {
+		t.Errorf("Expected to wait for the rollback, and got %s", aws.StringValue(s.Status))
+	}
+}
+
+func TestCreateOrUpdateWithContext(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")}},
+		},
+		BlockCreate: true,
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- s.CreateOrUpdateWithContext(ctx, generateParamers(1)) }()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected error :%s, and got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CreateOrUpdateWithContext did not return when the context expired")
+	}
+
+	// Already cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.ReadOutputsWithContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error :%s, and got %v", context.Canceled, err)
+	}
+}
+
+func TestTemplateMatches(t *testing.T) {
+	file, err := ioutil.TempFile("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"Resources": {"Bucket": {"Type": "AWS::S3::Bucket"}}, "Outputs": {}}`)
+	file.Close()
+
+	// Forgot to define client
+	sError := Stack{}
+	_, err = sError.TemplateMatches(file.Name())
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	// Same template with different formatting and key order
+	mock := &mockedClient{
+		RespGetTemplateOutput: &cloudformation.GetTemplateOutput{
+			TemplateBody: aws.String("{\n  \"Outputs\": {},\n  \"Resources\": {\"Bucket\": {\"Type\": \"AWS::S3::Bucket\"}}\n}"),
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	matches, err := s.TemplateMatches(file.Name())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !matches {
+		t.Errorf("Expected templates to match")
+	}
+
+	// Different template
+	mock.RespGetTemplateOutput.TemplateBody = aws.String(`{"Resources": {"Queue": {"Type": "AWS::SQS::Queue"}}}`)
+	matches, err = s.TemplateMatches(file.Name())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if matches {
+		t.Errorf("Expected templates to differ")
+	}
+}
+
+func TestCreateOrUpdateLogsDefaultedParameters(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key9"), DefaultValue: aws.String("d9")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key8"), DefaultValue: aws.String("d8")}},
+		},
+	}
+	var buf bytes.Buffer
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(&buf, "", 0)
+	err := s.CreateOrUpdate(generateParamers(1))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !strings.Contains(buf.String(), "Using template defaults for: [key8,key9]") {
+		t.Errorf("Expected defaulted parameters to be logged, and got: %s", buf.String())
+	}
+}
+
+func TestWithRegionDefaults(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("ImageId"), DefaultValue: aws.String("ami-default")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("KeyName")}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.WithRegionDefaults("us-east-1", map[string]string{"KeyName": "virginia"})
+	s.WithRegionDefaults("eu-west-1", map[string]string{"ImageId": "ami-ireland", "KeyName": "ireland"})
+
+	// Without a matching region the parameter is missing
+	err := s.CreateOrUpdate(generateParamers(1))
+	if err == nil || !strings.Contains(err.Error(), "Missing: [KeyName]") {
+		t.Errorf("Expected missing KeyName, and got %v", err)
+	}
+
+	s.Region = "eu-west-1"
+	err = s.CreateOrUpdate(map[string]string{"key1": "value1", "KeyName": "mine"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	values := make(map[string]string)
+	for _, p := range mock.CreateStackInput.Parameters {
+		values[*p.ParameterKey] = *p.ParameterValue
+	}
+	if values["ImageId"] != "ami-ireland" || values["KeyName"] != "mine" {
+		t.Errorf("Expected region default and caller value, and got %v", values)
+	}
+}
+
+func TestParseParameters(t *testing.T) {
+	content := "# database\nConnectionString=host=db;user=app\n\n  Env = prod  \n#Disabled=true\n"
+	parameters, err := parseParameters(strings.NewReader(content))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := map[string]string{"ConnectionString": "host=db;user=app", "Env": "prod"}
+	if !reflect.DeepEqual(parameters, expected) {
+		t.Errorf("Expected %v, and got %v", expected, parameters)
+	}
+
+	_, err = parseParameters(strings.NewReader("Env=prod\n# comment\nmalformed"))
+	if err == nil || err.Error() != "Invalid parameter at line 3, expected key=value: malformed" {
+		t.Errorf("Expected malformed line error, and got %v", err)
+	}
+}
+
+func TestLoadParametersEncrypted(t *testing.T) {
+	file, err := ioutil.TempFile("", "parameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("encrypted:key1=value1\nkey2=value2")
+	file.Close()
+
+	parameters, err := loadParametersEncrypted(&mockedKMSClient{}, file.Name())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(parameters) != 2 || parameters["key1"] != "value1" || parameters["key2"] != "value2" {
+		t.Errorf("Unexpected parameters: %v", parameters)
+	}
+
+	// Decryption errors
+	ioutil.WriteFile(file.Name(), []byte("plain"), 0644)
+	_, err = loadParametersEncrypted(&mockedKMSClient{}, file.Name())
+	if err == nil || !strings.Contains(err.Error(), "Unable to decrypt") {
+		t.Errorf("Expected decryption error, and got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	sError := Stack{}
+	err := sError.Export("stack.json")
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stack.json")
+
+	mock := &mockedClient{
+		RespGetTemplateOutput: &cloudformation.GetTemplateOutput{TemplateBody: aws.String(`{"Resources":{}}`)},
+		RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{&cloudformation.Stack{
+				Capabilities: aws.StringSlice([]string{"CAPABILITY_IAM"}),
+				Parameters: []*cloudformation.Parameter{
+					&cloudformation.Parameter{ParameterKey: aws.String("Env"), ParameterValue: aws.String("prod")},
+					&cloudformation.Parameter{ParameterKey: aws.String("Password"), ParameterValue: aws.String(redactedValue)},
+				},
+				Tags: []*cloudformation.Tag{&cloudformation.Tag{Key: aws.String("team"), Value: aws.String("platform")}},
+			}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.Export(path); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, parameters, err := ImportFromFile(mock, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Name != "name" || imported.TemplateBody != `{"Resources":{}}` || imported.TemplateURL != "" {
+		t.Errorf("Unexpected stack: %v", imported)
+	}
+	if !reflect.DeepEqual(imported.Capabilities, []string{"CAPABILITY_IAM"}) || !reflect.DeepEqual(imported.Tags, map[string]string{"team": "platform"}) {
+		t.Errorf("Unexpected capabilities or tags: %v %v", imported.Capabilities, imported.Tags)
+	}
+	if !reflect.DeepEqual(parameters, map[string]string{"Env": "prod"}) {
+		t.Errorf("Expected the parameters without NoEcho values, and got %v", parameters)
+	}
+
+	// Invalid files
+	if _, _, err := ImportFromFile(mock, path+".missing"); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+	ioutil.WriteFile(path, []byte(`{"name":"name"}`), 0600)
+	if _, _, err := ImportFromFile(mock, path); err == nil || !strings.Contains(err.Error(), "templateBody are required") {
+		t.Errorf("Expected invalid definition error, and got %v", err)
+	}
+}
+
+func TestDiffParametersFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "parameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("Env=prod\nSize=large\nNew=value")
+	file.Close()
+
+	mock := &mockedClient{
+		RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{&cloudformation.Stack{
+				Parameters: []*cloudformation.Parameter{
+					&cloudformation.Parameter{ParameterKey: aws.String("Env"), ParameterValue: aws.String("prod")},
+					&cloudformation.Parameter{ParameterKey: aws.String("Size"), ParameterValue: aws.String("small")},
+					&cloudformation.Parameter{ParameterKey: aws.String("Old"), ParameterValue: aws.String("gone")},
+				},
+			}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	diff, err := s.DiffParametersFile(file.Name())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := map[string][2]string{
+		"Size": {"small", "large"},
+		"New":  {"", "value"},
+		"Old":  {"gone", ""},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected %v, and got %v", expected, diff)
+	}
+
+	// Missing file
+	if _, err := s.DiffParametersFile(file.Name() + ".missing"); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+}
+
+func TestLoadParametersFromTemplate(t *testing.T) {
+	file, err := ioutil.TempFile("", "parameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("Env={{.Env}}\nBucketName={{.Env}}-{{.Region}}-assets\n{{range .Extra}}{{.}}\n{{end}}")
+	file.Close()
+
+	data := struct {
+		Env, Region string
+		Extra       []string
+	}{"dev", "eu-west-1", []string{"Debug=true"}}
+	parameters, err := LoadParametersFromTemplate(file.Name(), data)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := map[string]string{"Env": "dev", "BucketName": "dev-eu-west-1-assets", "Debug": "true"}
+	if !reflect.DeepEqual(parameters, expected) {
+		t.Errorf("Expected %v, and got %v", expected, parameters)
+	}
+
+	// Template errors
+	ioutil.WriteFile(file.Name(), []byte("Env={{.Missing}"), 0644)
+	if _, err = LoadParametersFromTemplate(file.Name(), data); err == nil {
+		t.Errorf("Expected template error")
+	}
+}
+
+func TestLoadParametersTOML(t *testing.T) {
+	file, err := ioutil.TempFile("", "parameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("Name = \"app\"\nCount = 3\nEnabled = true\nRatio = 0.5\n")
+	file.Close()
+
+	parameters, err := LoadParametersTOML(file.Name())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := map[string]string{"Name": "app", "Count": "3", "Enabled": "true", "Ratio": "0.5"}
+	if !reflect.DeepEqual(parameters, expected) {
+		t.Errorf("Expected %v, and got %v", expected, parameters)
+	}
+
+	// Nested tables and arrays are rejected
+	for _, content := range []string{"[Nested]\nKey = 1\n", "List = [1, 2]\n"} {
+		ioutil.WriteFile(file.Name(), []byte(content), 0644)
+		_, err = LoadParametersTOML(file.Name())
+		if err == nil || !strings.Contains(err.Error(), "Unsupported value") {
+			t.Errorf("Expected unsupported value error, and got %v", err)
+		}
+	}
+}
+
+func TestExportOutputsToEnv(t *testing.T) {
+	mock := &mockedClient{
+		RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{&cloudformation.Stack{
+				Outputs: []*cloudformation.Output{
+					&cloudformation.Output{OutputKey: aws.String("BucketName"), OutputValue: aws.String("my-bucket")},
+					&cloudformation.Output{OutputKey: aws.String("QueueUrl"), OutputValue: aws.String("https://queue")},
+				},
+			}},
+		},
+	}
+	defer os.Unsetenv("TEST_BucketName")
+	defer os.Unsetenv("TEST_QueueUrl")
+
+	s := NewStack(mock, "name", "url", []string{})
+	names, err := s.ExportOutputsToEnv("TEST_")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(names, ",") != "TEST_BucketName,TEST_QueueUrl" {
+		t.Errorf("Unexpected names: %v", names)
+	}
+	if os.Getenv("TEST_BucketName") != "my-bucket" || os.Getenv("TEST_QueueUrl") != "https://queue" {
+		t.Errorf("Expected outputs in the environment")
+	}
+}
+
+func TestFindMissingSSMParameters(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.findMissingSSMParameters(&mockedSSMClient{}, nil)
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	ssmType := "AWS::SSM::Parameter::Value<String>"
+	mock := &mockedClient{
+		RespTemplateSummaryOutput: &cloudformation.GetTemplateSummaryOutput{
+			Parameters: []*cloudformation.ParameterDeclaration{
+				&cloudformation.ParameterDeclaration{ParameterKey: aws.String("ImageId"), ParameterType: aws.String(ssmType), DefaultValue: aws.String("/ami/latest")},
+				&cloudformation.ParameterDeclaration{ParameterKey: aws.String("Subnet"), ParameterType: aws.String(ssmType)},
+				&cloudformation.ParameterDeclaration{ParameterKey: aws.String("Vpc"), ParameterType: aws.String(ssmType)},
+				&cloudformation.ParameterDeclaration{ParameterKey: aws.String("Env"), ParameterType: aws.String("String")},
+			},
+		},
+	}
+	ssmMock := &mockedSSMClient{Values: map[string]string{"/network/subnet": "subnet-1"}}
+	s := NewStack(mock, "name", "url", []string{})
+	missing, err := s.findMissingSSMParameters(ssmMock, map[string]string{
+		"Subnet": "/network/subnet",
+		"Vpc":    "/network/vpc",
+		"Env":    "/not/ssm",
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(missing, ",") != "/ami/latest,/network/vpc" {
+		t.Errorf("Unexpected missing parameters: %v", missing)
+	}
+}
+
+func stackWithOutputs(outputs map[string]string) *cloudformation.Stack {
+	stack := &cloudformation.Stack{}
+	for key, value := range outputs {
+		stack.Outputs = append(stack.Outputs, &cloudformation.Output{OutputKey: aws.String(key), OutputValue: aws.String(value)})
+	}
+	return stack
+}
+
+func TestReadOutput(t *testing.T) {
+	mock := &mockedClient{StacksByName: map[string]*cloudformation.Stack{
+		"name": stackWithOutputs(map[string]string{"Endpoint": "https://api"}),
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+	value, err := s.ReadOutput("Endpoint")
+	if err != nil || value != "https://api" {
+		t.Errorf("Expected https://api, and got %s %v", value, err)
+	}
+	_, err = s.ReadOutput("Missing")
+	if err == nil || err.Error() != `ReadOutput name: output "Missing" not found` {
+		t.Errorf("Expected not found error, and got %v", err)
+	}
+}
+
+func TestReadOutputsWithExports(t *testing.T) {
+	sError := Stack{}
+	if _, err := sError.ReadOutputsWithExports(); err == nil || err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %v", messageClientNotDefined, err)
+	}
+
+	mock := &mockedClient{StacksByName: map[string]*cloudformation.Stack{
+		"name": {Outputs: []*cloudformation.Output{
+			{OutputKey: aws.String("VpcId"), OutputValue: aws.String("vpc-1"), Description: aws.String("The VPC"), ExportName: aws.String("network-VpcId")},
+			{OutputKey: aws.String("Endpoint"), OutputValue: aws.String("https://api")},
+		}},
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+	outputs, err := s.ReadOutputsWithExports()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := map[string]Output{
+		"VpcId":    {Value: "vpc-1", Description: "The VPC", ExportName: "network-VpcId"},
+		"Endpoint": {Value: "https://api"},
+	}
+	if !reflect.DeepEqual(outputs, expected) {
+		t.Errorf("Expected %v, and got %v", expected, outputs)
+	}
+}
+
+func TestDiffStackOutputs(t *testing.T) {
+	mock := &mockedClient{StacksByName: map[string]*cloudformation.Stack{
+		"blue":  stackWithOutputs(map[string]string{"Url": "https://blue", "Version": "1", "OnlyBlue": "b"}),
+		"green": stackWithOutputs(map[string]string{"Url": "https://green", "Version": "1", "OnlyGreen": "g"}),
+	}}
+	diff, err := diffStackOutputs(mock, "blue", "green")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := map[string][2]string{
+		"Url":       {"https://blue", "https://green"},
+		"OnlyBlue":  {"b", ""},
+		"OnlyGreen": {"", "g"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected %v, and got %v", expected, diff)
+	}
+
+	if _, err := diffStackOutputs(mock, "blue", "missing"); err == nil {
+		t.Errorf("Expected error for a missing stack")
+	}
+}
+
+func TestStatusReason(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.StatusReason()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{
+		RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{&cloudformation.Stack{
+				StackName:         aws.String("name"),
+				StackStatus:       aws.String(cloudformation.StackStatusUpdateRollbackComplete),
+				StackStatusReason: aws.String("The following resource(s) failed to update: [Bucket]."),
+			}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	reason, err := s.StatusReason()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if reason != "The following resource(s) failed to update: [Bucket]." {
+		t.Errorf("Unexpected reason: %s", reason)
+	}
+	if aws.StringValue(s.Status) != cloudformation.StackStatusUpdateRollbackComplete {
+		t.Errorf("Expected status to be refreshed, and got %v", aws.StringValue(s.Status))
+	}
+}
+
+func TestWaitUntilSettled(t *testing.T) {
+	stackPollInterval = 0
+
+	sError := Stack{}
+	_, err := sError.WaitUntilSettled(context.Background())
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{Statuses: []string{
+		cloudformation.StackStatusUpdateInProgress,
+		cloudformation.StackStatusUpdateRollbackInProgress,
+		cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress,
+		cloudformation.StackStatusUpdateRollbackFailed,
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+	status, err := s.WaitUntilSettled(context.Background())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if status != cloudformation.StackStatusUpdateRollbackFailed {
+		t.Errorf("Expected status %s, and got %s", cloudformation.StackStatusUpdateRollbackFailed, status)
+	}
+	if mock.describeCalls != 4 {
+		t.Errorf("Expected 4 status checks, and got %d", mock.describeCalls)
+	}
+
+	// A stack waiting for its change set to be executed does not change on its own
+	mock = &mockedClient{Statuses: []string{cloudformation.StackStatusReviewInProgress, cloudformation.StackStatusCreateInProgress}}
+	s = NewStack(mock, "name", "url", []string{})
+	if status, err := s.WaitUntilSettled(context.Background()); err != nil || status != cloudformation.StackStatusReviewInProgress {
+		t.Errorf("Expected status %s, and got %s %v", cloudformation.StackStatusReviewInProgress, status, err)
+	}
+
+	// Cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mock = &mockedClient{Statuses: []string{cloudformation.StackStatusCreateInProgress}}
+	s = NewStack(mock, "name", "url", []string{})
+	if _, err := s.WaitUntilSettled(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error :%s, and got %v", context.Canceled, err)
+	}
+}
+
+func TestWaitForRollback(t *testing.T) {
+	stackPollInterval = 0
+
+	mock := &mockedClient{Statuses: []string{
+		cloudformation.StackStatusUpdateRollbackInProgress,
+		cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress,
+		cloudformation.StackStatusUpdateRollbackComplete,
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.WaitForRollback(context.Background()); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	mock = &mockedClient{Statuses: []string{
+		cloudformation.StackStatusUpdateRollbackInProgress,
+		cloudformation.StackStatusUpdateRollbackFailed,
+	}}
+	s = NewStack(mock, "name", "url", []string{})
+	err := s.WaitForRollback(context.Background())
+	if err == nil || err.Error() != "WaitForRollback name: Rollback finished with status UPDATE_ROLLBACK_FAILED" {
+		t.Errorf("Expected rollback failure, and got %v", err)
+	}
+}
+
+func TestWaitForImport(t *testing.T) {
+	stackPollInterval = 0
+
+	mock := &mockedClient{Statuses: []string{
+		cloudformation.StackStatusImportInProgress,
+		cloudformation.StackStatusImportInProgress,
+		cloudformation.StackStatusImportComplete,
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.WaitForImport(context.Background()); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.describeCalls != 3 {
+		t.Errorf("Expected 3 status checks, and got %d", mock.describeCalls)
+	}
+
+	mock = &mockedClient{Statuses: []string{
+		cloudformation.StackStatusImportInProgress,
+		cloudformation.StackStatusImportRollbackInProgress,
+		cloudformation.StackStatusImportRollbackComplete,
+	}}
+	s = NewStack(mock, "name", "url", []string{})
+	err := s.WaitForImport(context.Background())
+	if err == nil || err.Error() != "WaitForImport name: Import finished with status IMPORT_ROLLBACK_COMPLETE" {
+		t.Errorf("Expected import failure, and got %v", err)
+	}
+}
+
+func TestDeleteStack(t *testing.T) {
+	sError := Stack{}
+	err := sError.DeleteStack()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.DeleteStack(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.DeletedStacks) != 1 || mock.DeletedStacks[0] != "name" {
+		t.Errorf("Expected stack name to be deleted, and got %v", mock.DeletedStacks)
+	}
+
+	// Stack not found
+	mock = &mockedClient{DeleteStackErr: awserr.New("ValidationError", "Stack with id name does not exist", nil)}
+	s = NewStack(mock, "name", "url", []string{})
+	err = s.DeleteStack()
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "ValidationError" {
+		t.Errorf("Expected ValidationError, and got %v", err)
+	}
+}
+
+func TestSetTerminationProtection(t *testing.T) {
+	sError := Stack{}
+	err := sError.SetTerminationProtection(true)
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{}
+	s := NewStack(mock, "name", "url", []string{})
+	if err := s.SetTerminationProtection(true); err != nil {
+		t.Errorf(err.Error())
+	}
+	input := mock.TerminationProtectionInput
+	if aws.StringValue(input.StackName) != "name" || !aws.BoolValue(input.EnableTerminationProtection) {
+		t.Errorf("Unexpected input: %v", input)
+	}
+	s.SetTerminationProtection(false)
+	if aws.BoolValue(mock.TerminationProtectionInput.EnableTerminationProtection) {
+		t.Errorf("Expected protection to be disabled")
+	}
+
+	// Enabled on creation
+	mock.RespValidateTemplateOutput = &cloudformation.ValidateTemplateOutput{}
+	s.CreateOrUpdate(map[string]string{})
+	if mock.CreateStackInput.EnableTerminationProtection != nil {
+		t.Errorf("Expected no protection by default")
+	}
+	s.EnableTerminationProtection = true
+	s.CreateOrUpdate(map[string]string{})
+	if !aws.BoolValue(mock.CreateStackInput.EnableTerminationProtection) {
+		t.Errorf("Expected protection on creation")
+	}
+}
+
+func TestDeleteRetaining(t *testing.T) {
+	sError := Stack{}
+	err := sError.DeleteRetaining([]string{"Bucket"})
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{
+		RespDescribeStackResourcesOutput: &cloudformation.DescribeStackResourcesOutput{
+			StackResources: []*cloudformation.StackResource{
+				&cloudformation.StackResource{LogicalResourceId: aws.String("Bucket"), PhysicalResourceId: aws.String("my-bucket")},
+				&cloudformation.StackResource{LogicalResourceId: aws.String("Table"), PhysicalResourceId: aws.String("my-table")},
+				&cloudformation.StackResource{LogicalResourceId: aws.String("Queue"), PhysicalResourceId: aws.String("my-queue")}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err := s.DeleteRetaining([]string{"Bucket", "Table"}); err != nil {
+		t.Errorf(err.Error())
+	}
+	retained := aws.StringValueSlice(mock.DeleteStackInput.RetainResources)
+	if len(retained) != 2 || retained[0] != "Bucket" || retained[1] != "Table" {
+		t.Errorf("Unexpected retained resources: %v", retained)
+	}
+
+	// Unknown resource
+	mock.DeleteStackInput = nil
+	if err := s.DeleteRetaining([]string{"Unknown"}); err == nil || mock.DeleteStackInput != nil {
+		t.Errorf("Expected error and no deletion for an unknown resource")
+	}
+}
+
+func TestListChangeSets(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.ListChangeSets()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{
+		ChangeSetPages: map[string]*cloudformation.ListChangeSetsOutput{
+			"": &cloudformation.ListChangeSetsOutput{
+				Summaries: []*cloudformation.ChangeSetSummary{&cloudformation.ChangeSetSummary{ChangeSetName: aws.String("cs1")}},
+				NextToken: aws.String("page2"),
+			},
+			"page2": &cloudformation.ListChangeSetsOutput{
+				Summaries: []*cloudformation.ChangeSetSummary{&cloudformation.ChangeSetSummary{ChangeSetName: aws.String("cs2")}},
+			},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	summaries, err := s.ListChangeSets()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(summaries) != 2 || *summaries[0].ChangeSetName != "cs1" || *summaries[1].ChangeSetName != "cs2" {
+		t.Errorf("Expected the change sets of both pages, and got %v", summaries)
+	}
+}
+
+func TestDeployLocalTemplate(t *testing.T) {
+	file, err := ioutil.TempFile("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"Resources": {}}`)
+	file.Close()
+
+	sError := Stack{}
+	err = sError.DeployLocalTemplate(file.Name(), "scratch", "eu-west-1", nil)
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	s3Mock := &mockedS3Client{}
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key2")}},
+		},
+	}
+	s := NewStack(mock, "name", "", []string{})
+	err = s.deployLocalTemplate(s3Mock, file.Name(), "scratch", "eu-west-1", generateParamers(2))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	key := "name/" + filepath.Base(file.Name())
+	if len(s3Mock.Uploaded) != 1 || *s3Mock.Uploaded[0].Bucket != "scratch" || *s3Mock.Uploaded[0].Key != key {
+		t.Errorf("Expected the template to be uploaded to the scratch bucket")
+	}
+	if s.TemplateURL != "https://scratch.s3.eu-west-1.amazonaws.com/"+key {
+		t.Errorf("Unexpected template url: %s", s.TemplateURL)
+	}
+
+	// Missing parameters are reported before deploying
+	err = s.deployLocalTemplate(s3Mock, file.Name(), "scratch", "eu-west-1", generateParamers(1))
+	if err == nil || !strings.Contains(err.Error(), "key2") {
+		t.Errorf("Expected missing key2, and got %v", err)
+	}
+}
+
+func TestCreateStackCancelledCleanup(t *testing.T) {
+	mock := &mockedClient{BlockCreate: true}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := s.createStackOrCleanup(ctx, generateParamers(1))
+	if err != context.Canceled {
+		t.Errorf("Expected error :%s, and got %v", context.Canceled, err)
+	}
+	stackID := "arn:aws:cloudformation:us-east-1:111111111111:stack/name/guid"
+	if mock.DeleteStackInput == nil || *mock.DeleteStackInput.StackName != stackID {
+		t.Errorf("Expected the cancelled stack to be deleted by id")
+	}
+
+	// No cleanup when the stack should be kept or was never created
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	mock = &mockedClient{BlockCreate: true}
+	s = NewStack(mock, "name", "url", []string{})
+	s.OnFailure = cloudformation.OnFailureDoNothing
+	if err := s.createStackOrCleanup(cancelled, generateParamers(1)); err != context.Canceled || mock.DeleteStackInput != nil {
+		t.Errorf("Expected the stack to be kept with DO_NOTHING, and got %v %v", err, mock.DeleteStackInput)
+	}
+	mock = &mockedClient{CreateStackErr: context.Canceled}
+	s = NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err := s.createStackOrCleanup(cancelled, generateParamers(1)); err != context.Canceled || mock.DeleteStackInput != nil {
+		t.Errorf("Expected no deletion of a stack never created, and got %v %v", err, mock.DeleteStackInput)
+	}
+
+	// No cleanup when the creation succeeds
+	mock = &mockedClient{}
+	s = NewStack(mock, "name", "url", []string{})
+	if err := s.createStackOrCleanup(context.Background(), generateParamers(1)); err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.DeleteStackInput != nil {
+		t.Errorf("Expected no deletion")
+	}
+}
+
+func TestGetParameters(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.GetParameters()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{
+		RespDescribeStacksOutput: &cloudformation.DescribeStacksOutput{
+			Stacks: []*cloudformation.Stack{&cloudformation.Stack{
+				StackName: aws.String("name"),
+				Parameters: []*cloudformation.Parameter{
+					&cloudformation.Parameter{ParameterKey: aws.String("Env"), ParameterValue: aws.String("dev")},
+					&cloudformation.Parameter{ParameterKey: aws.String("Size"), ParameterValue: aws.String("2")},
+					&cloudformation.Parameter{ParameterKey: aws.String("Password"), ParameterValue: aws.String("****")}},
+			}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	parameters, err := s.GetParameters()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(parameters) != 2 || parameters["Env"] != "dev" || parameters["Size"] != "2" {
+		t.Errorf("Unexpected parameters: %v", parameters)
+	}
+}
+
+func TestRequiredOverride(t *testing.T) {
+	mock := &mockedClient{
+		RespValidateTemplateOutput: &cloudformation.ValidateTemplateOutput{
+			Parameters: []*cloudformation.TemplateParameter{
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("key1")},
+				&cloudformation.TemplateParameter{ParameterKey: aws.String("Env"), DefaultValue: aws.String("dev")}},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err := s.CreateOrUpdate(generateParamers(1)); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	s.RequiredOverride = []string{"Env"}
+	err := s.CreateOrUpdate(generateParamers(1))
+	if err == nil || !strings.Contains(err.Error(), "Env") {
+		t.Errorf("Expected Env to be required, and got %v", err)
+	}
+
+	parameters := generateParamers(1)
+	parameters["Env"] = "prod"
+	if err := s.CreateOrUpdate(parameters); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestStackError(t *testing.T) {
+	mock := &mockedClient{}
+	s := NewStack(mock, "name", "url", []string{})
+	_, err := s.ReadOutputs()
+
+	var stackErr *StackError
+	if !errors.As(err, &stackErr) {
+		t.Fatalf("Expected a StackError, and got %v", err)
+	}
+	if stackErr.Name != "name" || stackErr.Op != "ReadOutputs" || stackErr.Err.Error() != "ValidationError: Stack with id name does not exist" {
+		t.Errorf("Unexpected StackError: %v", stackErr)
+	}
+	if err.Error() != "ReadOutputs name: ValidationError: Stack with id name does not exist" {
+		t.Errorf("Unexpected message: %s", err.Error())
+	}
+	if errors.Unwrap(err) != stackErr.Err {
+		t.Errorf("Expected Unwrap to return the underlying error")
+	}
+}
+
+func stackSummary(name, status string, age time.Duration) *cloudformation.StackSummary {
+	return &cloudformation.StackSummary{
+		StackName:    aws.String(name),
+		StackStatus:  aws.String(status),
+		CreationTime: aws.Time(time.Now().Add(-age)),
+	}
+}
+
+func TestDeleteStaleStacks(t *testing.T) {
+	mock := &mockedClient{
+		StackPages: map[string]*cloudformation.ListStacksOutput{
+			"": &cloudformation.ListStacksOutput{
+				StackSummaries: []*cloudformation.StackSummary{
+					stackSummary("sandbox-old", cloudformation.StackStatusCreateComplete, 48*time.Hour),
+					stackSummary("sandbox-new", cloudformation.StackStatusCreateComplete, time.Hour),
+					stackSummary("prod-old", cloudformation.StackStatusCreateComplete, 48*time.Hour),
+				},
+				NextToken: aws.String("page2"),
+			},
+			"page2": &cloudformation.ListStacksOutput{
+				StackSummaries: []*cloudformation.StackSummary{
+					stackSummary("sandbox-busy", cloudformation.StackStatusUpdateInProgress, 48*time.Hour),
+					stackSummary("sandbox-gone", cloudformation.StackStatusDeleteComplete, 48*time.Hour),
+					stackSummary("sandbox-failed", cloudformation.StackStatusRollbackComplete, 30*time.Hour),
+				},
+			},
+		},
+	}
+	deleted, err := deleteStaleStacks(mock, "sandbox-", 24*time.Hour)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(deleted) != 2 || deleted[0] != "sandbox-old" || deleted[1] != "sandbox-failed" {
+		t.Errorf("Unexpected deleted stacks: %v", deleted)
+	}
+	if len(mock.DeletedStacks) != 2 {
+		t.Errorf("Expected two DeleteStack calls, and got %v", mock.DeletedStacks)
+	}
+}
+
+func TestResourceIDMap(t *testing.T) {
+	sError := Stack{}
+	_, err := sError.ResourceIDMap()
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedClient{
+		ResourcePages: map[string]*cloudformation.ListStackResourcesOutput{
+			"": &cloudformation.ListStackResourcesOutput{
+				StackResourceSummaries: []*cloudformation.StackResourceSummary{
+					&cloudformation.StackResourceSummary{LogicalResourceId: aws.String("Bucket"), PhysicalResourceId: aws.String("my-bucket")}},
+				NextToken: aws.String("page2"),
+			},
+			"page2": &cloudformation.ListStackResourcesOutput{
+				StackResourceSummaries: []*cloudformation.StackResourceSummary{
+					&cloudformation.StackResourceSummary{LogicalResourceId: aws.String("Queue"), PhysicalResourceId: aws.String("https://queue")}},
+			},
+		},
+	}
+	s := NewStack(mock, "name", "url", []string{})
+	ids, err := s.ResourceIDMap()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(ids) != 2 || ids["Bucket"] != "my-bucket" || ids["Queue"] != "https://queue" {
+		t.Errorf("Unexpected resource ids: %v", ids)
+	}
+}
+
+func export(stack, name string) *cloudformation.Export {
+	return &cloudformation.Export{
+		ExportingStackId: aws.String("arn:aws:cloudformation:us-east-1:123456789012:stack/" + stack + "/guid"),
+		Name:             aws.String(name),
+	}
+}
+
+// exportPolls returns its polls one by one from ListExports, the last one is repeated.
+type exportPolls struct {
+	*mockedClient
+	polls [][]*cloudformation.Export
+	calls int
+}
+
+func (m *exportPolls) ListExports(in *cloudformation.ListExportsInput) (*cloudformation.ListExportsOutput, error) {
+	i := m.calls
+	if i >= len(m.polls) {
+		i = len(m.polls) - 1
+	}
+	m.calls++
+	return &cloudformation.ListExportsOutput{Exports: m.polls[i]}, nil
+}
+
+func TestWaitForExport(t *testing.T) {
+	stackPollInterval = 0
+
+	vpc := export("network", "network-VpcId")
+	vpc.Value = aws.String("vpc-1")
+	mock := &exportPolls{polls: [][]*cloudformation.Export{{export("other", "other-Id")}, {vpc}}}
+	value, err := waitForExport(mock, "network-VpcId", time.Minute)
+	if err != nil || value != "vpc-1" {
+		t.Errorf("Expected vpc-1, and got %s %v", value, err)
+	}
+	if mock.calls != 2 {
+		t.Errorf("Expected 2 polls, and got %d", mock.calls)
+	}
+
+	mock = &exportPolls{polls: [][]*cloudformation.Export{{}}}
+	_, err = waitForExport(mock, "network-VpcId", 0)
+	if err == nil || err.Error() != "Export network-VpcId not available after 0s" {
+		t.Errorf("Expected timeout error, and got %v", err)
+	}
+
+	// The wait does not outlast the timeout
+	stackPollInterval = time.Hour
+	defer func() { stackPollInterval = 0 }()
+	start := time.Now()
+	_, err = waitForExport(mock, "network-VpcId", 10*time.Millisecond)
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected timeout error after 10ms, and got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestDetectExportCycles(t *testing.T) {
+	mock := &mockedClient{
+		Exports: []*cloudformation.Export{
+			export("network", "VpcId"),
+			export("app", "AppUrl"),
+			export("db", "DbHost"),
+			export("other", "OtherValue"),
+		},
+		Imports: map[string][]string{
+			"VpcId":      []string{"app", "db"},
+			"AppUrl":     []string{"network"},
+			"OtherValue": []string{"db"},
+		},
+	}
+	cycles, err := detectExportCycles(mock, []string{"network", "app", "db"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(cycles) != 1 || strings.Join(cycles[0], ",") != "app,network" {
+		t.Errorf("Expected the app/network cycle, and got %v", cycles)
+	}
+
+	// No cycle without the app stack
+	cycles, err = detectExportCycles(mock, []string{"network", "db"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(cycles) != 0 {
+		t.Errorf("Expected no cycles, and got %v", cycles)
+	}
+}
+
+func stackEvent(id, logicalID, resourceType, status string) *cloudformation.StackEvent {
+	return &cloudformation.StackEvent{
+		EventId:           aws.String(id),
+		LogicalResourceId: aws.String(logicalID),
+		ResourceType:      aws.String(resourceType),
+		ResourceStatus:    aws.String(status),
+		Timestamp:         aws.Time(time.Now()),
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	stackPollInterval = 0
+
+	started := stackEvent("1", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateInProgress)
+	bucket := stackEvent("2", "Bucket", "AWS::S3::Bucket", cloudformation.ResourceStatusCreateInProgress)
+	bucketDone := stackEvent("3", "Bucket", "AWS::S3::Bucket", cloudformation.ResourceStatusCreateComplete)
+	done := stackEvent("4", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateComplete)
+	mock := &mockedClient{EventPolls: [][]*cloudformation.StackEvent{
+		{bucket, started},
+		{bucket, started},
+		{bucketDone, bucket, started},
+		{done, bucketDone, bucket, started},
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+
+	events, errs := s.StreamEvents(context.Background())
+	ids := make([]string, 0)
+	for event := range events {
+		ids = append(ids, *event.EventId)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(ids, ",") != "1,2,3,4" {
+		t.Errorf("Expected each event once in order, and got %v", ids)
+	}
+
+	// Cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mock = &mockedClient{EventPolls: [][]*cloudformation.StackEvent{{started}}}
+	s = NewStack(mock, "name", "url", []string{})
+	events, errs = s.StreamEvents(ctx)
+	for range events {
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error :%s, and got %v", context.Canceled, err)
+	}
+}
+
+func TestStreamEventsHistory(t *testing.T) {
+	stackPollInterval = 0
+
+	created := stackEvent("1", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateInProgress)
+	createDone := stackEvent("2", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateComplete)
+	updated := stackEvent("3", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusUpdateInProgress)
+	bucket := stackEvent("4", "Bucket", "AWS::S3::Bucket", cloudformation.ResourceStatusUpdateComplete)
+	updateDone := stackEvent("5", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusUpdateComplete)
+	stream := func(polls [][]*cloudformation.StackEvent) string {
+		s := NewStack(&mockedClient{EventPolls: polls}, "name", "url", []string{})
+		s.StreamNextOperation = true
+		events, errs := s.StreamEvents(context.Background())
+		ids := make([]string, 0)
+		for event := range events {
+			ids = append(ids, *event.EventId)
+		}
+		if err := <-errs; err != nil {
+			t.Errorf(err.Error())
+		}
+		return strings.Join(ids, ",")
+	}
+
+	// Started before the update, the previous operation is skipped and the stream waits for the update
+	ids := stream([][]*cloudformation.StackEvent{
+		{createDone, created},
+		{updated, createDone, created},
+		{updateDone, bucket, updated, createDone, created},
+	})
+	if ids != "3,4,5" {
+		t.Errorf("Expected only the update events, and got %v", ids)
+	}
+
+	// Started during the update
+	ids = stream([][]*cloudformation.StackEvent{
+		{bucket, updated, createDone, created},
+		{updateDone, bucket, updated, createDone, created},
+	})
+	if ids != "3,4,5" {
+		t.Errorf("Expected only the update events, and got %v", ids)
+	}
+}
+
+func TestStreamEventsSettled(t *testing.T) {
+	stackPollInterval = 0
+
+	created := stackEvent("1", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateInProgress)
+	createDone := stackEvent("2", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateComplete)
+	mock := &mockedClient{EventPolls: [][]*cloudformation.StackEvent{{createDone, created}}}
+	s := NewStack(mock, "name", "url", []string{})
+
+	events, errs := s.StreamEvents(context.Background())
+	for event := range events {
+		t.Errorf("Expected no event, and got %v", event)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf(err.Error())
+	}
+	if mock.eventsCalls != 1 {
+		t.Errorf("Expected a single poll, and got %d", mock.eventsCalls)
+	}
+}
+
+func TestStreamEventsPages(t *testing.T) {
+	stackPollInterval = 0
+
+	polls := [][]*cloudformation.StackEvent{{stackEvent("0", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusUpdateComplete)}}
+	// a busy update adds more than a page of events between two polls
+	for _, batch := range [][]string{{"1", "2", "3"}, {"4", "5", "6", "7", "8"}} {
+		previous := polls[len(polls)-1]
+		next := make([]*cloudformation.StackEvent, 0)
+		for i := len(batch) - 1; i >= 0; i-- {
+			status := cloudformation.ResourceStatusUpdateInProgress
+			if batch[i] == "8" {
+				status = cloudformation.ResourceStatusUpdateComplete
+			}
+			resourceType := "AWS::S3::Bucket"
+			if batch[i] == "1" || batch[i] == "8" {
+				resourceType = "AWS::CloudFormation::Stack"
+			}
+			next = append(next, stackEvent(batch[i], "name", resourceType, status))
+		}
+		polls = append(polls, append(next, previous...))
+	}
+	mock := &mockedClient{EventPolls: polls, EventPageSize: 2}
+	s := NewStack(mock, "name", "url", []string{})
+	s.StreamNextOperation = true
+
+	events, errs := s.StreamEvents(context.Background())
+	ids := make([]string, 0)
+	for event := range events {
+		ids = append(ids, *event.EventId)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf(err.Error())
+	}
+	if strings.Join(ids, ",") != "1,2,3,4,5,6,7,8" {
+		t.Errorf("Expected the events of every page, and got %v", ids)
+	}
+}
+
+func TestWriteEvents(t *testing.T) {
+	stackPollInterval = 0
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	started := stackEvent("1", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusCreateInProgress)
+	bucket := stackEvent("2", "Bucket", "AWS::S3::Bucket", cloudformation.ResourceStatusCreateFailed)
+	bucket.ResourceStatusReason = aws.String("Bucket exists")
+	done := stackEvent("3", "name", "AWS::CloudFormation::Stack", cloudformation.ResourceStatusRollbackComplete)
+	for _, event := range []*cloudformation.StackEvent{started, bucket, done} {
+		event.Timestamp = aws.Time(at)
+	}
+	mock := &mockedClient{EventPolls: [][]*cloudformation.StackEvent{
+		{started},
+		{bucket, started},
+		{done, bucket, started},
+	}}
+	s := NewStack(mock, "name", "url", []string{})
+
+	var out bytes.Buffer
+	if err := s.WriteEvents(context.Background(), &out); err != nil {
+		t.Errorf(err.Error())
+	}
+	expected := "2020-01-02T03:04:05Z\tname\tCREATE_IN_PROGRESS\t\n" +
+		"2020-01-02T03:04:05Z\tBucket\tCREATE_FAILED\tBucket exists\n" +
+		"2020-01-02T03:04:05Z\tname\tROLLBACK_COMPLETE\t\n"
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nand got:\n%s", expected, out.String())
+	}
+	// A stack that is not changing has nothing to write
+	out.Reset()
+	mock = &mockedClient{EventPolls: [][]*cloudformation.StackEvent{{done, bucket, started}}}
+	s = NewStack(mock, "name", "url", []string{})
+	if err := s.WriteEvents(context.Background(), &out); err != nil || out.Len() != 0 {
+		t.Errorf("Expected nothing written, and got %q %v", out.String(), err)
+	}
+}
+
+func TestGetAllStacksByPages(t *testing.T) {
+	first := stackSummary("first", cloudformation.StackStatusCreateComplete, time.Hour)
+	first.StackId = aws.String("arn:aws:cloudformation:us-east-1:123456789012:stack/first/1")
+	mock := &mockedClient{StackPages: map[string]*cloudformation.ListStacksOutput{
+		"":     {StackSummaries: []*cloudformation.StackSummary{first}, NextToken: aws.String("next")},
+		"next": {StackSummaries: []*cloudformation.StackSummary{stackSummary("second", cloudformation.StackStatusUpdateComplete, time.Hour)}},
+	}}
+	stacks, err := getAllStacksBy(mock)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(stacks) != 2 || stacks[0].Name != "first" || stacks[1].Name != "second" {
+		t.Errorf("Expected the stacks of both pages, and got %v", stacks)
+	}
+	if stacks[0].StackID != *first.StackId {
+		t.Errorf("Expected the stack id to be set, and got %s", stacks[0].StackID)
+	}
+}
+
+func TestGetStacksLimited(t *testing.T) {
+	mock := &mockedClient{StackPages: map[string]*cloudformation.ListStacksOutput{
+		"": {StackSummaries: []*cloudformation.StackSummary{
+			stackSummary("first", cloudformation.StackStatusCreateComplete, time.Hour),
+			stackSummary("second", cloudformation.StackStatusCreateComplete, time.Hour),
+		}, NextToken: aws.String("next")},
+		"next": {StackSummaries: []*cloudformation.StackSummary{
+			stackSummary("third", cloudformation.StackStatusCreateComplete, time.Hour),
+		}},
+	}}
+	stacks, err := getStacksLimited(mock, 2)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(stacks) != 2 || stacks[1].Name != "second" || mock.listStacksCalls != 1 {
+		t.Errorf("Expected 2 stacks from the first page, and got %v after %d calls", stacks, mock.listStacksCalls)
+	}
+
+	mock.listStacksCalls = 0
+	stacks, _ = getStacksLimited(mock, 0)
+	if len(stacks) != 3 || mock.listStacksCalls != 2 {
+		t.Errorf("Expected every stack, and got %v after %d calls", stacks, mock.listStacksCalls)
+	}
+}
+
+func TestGetAllStacksBy(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    map[string]*cloudformation.ListStacksOutput
+		expected []string
+	}{
+		{
+			name:     "empty",
+			pages:    map[string]*cloudformation.ListStacksOutput{"": {}},
+			expected: []string{},
+		},
+		{
+			name: "deleted stacks are filtered",
+			pages: map[string]*cloudformation.ListStacksOutput{"": {StackSummaries: []*cloudformation.StackSummary{
+				stackSummary("live", cloudformation.StackStatusUpdateRollbackComplete, time.Hour),
+				stackSummary("gone", cloudformation.StackStatusDeleteComplete, time.Hour),
+				stackSummary("review", cloudformation.StackStatusReviewInProgress, time.Hour),
+			}}},
+			expected: []string{"live", "review"},
+		},
+		{
+			name: "every page is read",
+			pages: map[string]*cloudformation.ListStacksOutput{
+				"":  {StackSummaries: []*cloudformation.StackSummary{stackSummary("a", cloudformation.StackStatusCreateComplete, time.Hour)}, NextToken: aws.String("2")},
+				"2": {StackSummaries: []*cloudformation.StackSummary{stackSummary("b", cloudformation.StackStatusDeleteComplete, time.Hour)}, NextToken: aws.String("3")},
+				"3": {StackSummaries: []*cloudformation.StackSummary{stackSummary("c", cloudformation.StackStatusCreateFailed, time.Hour)}},
+			},
+			expected: []string{"a", "c"},
+		},
+	}
+	for _, test := range tests {
+		mock := &mockedClient{StackPages: test.pages}
+		stacks, err := getAllStacksBy(mock)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		}
+		names := make([]string, 0)
+		for _, stack := range stacks {
+			names = append(names, stack.Name)
+			if stack.cfn != mock {
+				t.Errorf("%s: expected the stack to use the client", test.name)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, and got %v", test.name, test.expected, names)
+		}
+	}
 }
@@ -0,0 +1,82 @@
+package awsutils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// stackSetPollInterval is the delay between DescribeStackSetOperation calls.
+var stackSetPollInterval = 10 * time.Second
+
+//StackSet ... Aws Cloud formation stack set
+type StackSet struct {
+	cfn          cloudformationiface.CloudFormationAPI
+	Name         string
+	TemplateURL  string
+	Capabilities []string
+}
+
+func NewStackSet(client cloudformationiface.CloudFormationAPI, name, templateURL string, capabilities []string) StackSet {
+	return StackSet{cfn: client, Name: name, TemplateURL: templateURL, Capabilities: capabilities}
+}
+
+//CreateStackSet ... creates the stack set with the given parameters
+func (s *StackSet) CreateStackSet(parameters map[string]string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	input := &cloudformation.CreateStackSetInput{
+		StackSetName: aws.String(s.Name),
+		TemplateURL:  aws.String(s.TemplateURL),
+		Capabilities: aws.StringSlice(s.Capabilities),
+		Parameters:   convertToCfnParameter(parameters),
+	}
+	_, err := s.cfn.CreateStackSet(input)
+	return err
+}
+
+//CreateStackInstances ... deploys the stack set to every account/region pair and waits for the operation to finish
+func (s *StackSet) CreateStackInstances(accounts, regions []string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	input := &cloudformation.CreateStackInstancesInput{
+		StackSetName: aws.String(s.Name),
+		Accounts:     aws.StringSlice(accounts),
+		Regions:      aws.StringSlice(regions),
+	}
+	resp, err := s.cfn.CreateStackInstances(input)
+	if err != nil {
+		return err
+	}
+	return s.WaitForOperation(aws.StringValue(resp.OperationId))
+}
+
+//WaitForOperation ... polls a stack set operation until it is no longer running
+func (s *StackSet) WaitForOperation(operationID string) error {
+	if s.cfn == nil {
+		return fmt.Errorf(messageClientNotDefined)
+	}
+	input := &cloudformation.DescribeStackSetOperationInput{
+		StackSetName: aws.String(s.Name),
+		OperationId:  aws.String(operationID),
+	}
+	for {
+		resp, err := s.cfn.DescribeStackSetOperation(input)
+		if err != nil {
+			return err
+		}
+		status := aws.StringValue(resp.StackSetOperation.Status)
+		switch status {
+		case cloudformation.StackSetOperationStatusSucceeded:
+			return nil
+		case cloudformation.StackSetOperationStatusFailed, cloudformation.StackSetOperationStatusStopped:
+			return fmt.Errorf("Stack set operation %s finished with status %s", operationID, status)
+		}
+		time.Sleep(stackSetPollInterval)
+	}
+}
@@ -0,0 +1,79 @@
+package awsutils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+/*Mock stuff*/
+type mockedStackSetClient struct {
+	cloudformationiface.CloudFormationAPI
+	CreateStackSetInput       *cloudformation.CreateStackSetInput
+	CreateStackInstancesInput *cloudformation.CreateStackInstancesInput
+	OperationStatuses         []string
+	describeCalls             int
+}
+
+func (m *mockedStackSetClient) CreateStackSet(in *cloudformation.CreateStackSetInput) (*cloudformation.CreateStackSetOutput, error) {
+	m.CreateStackSetInput = in
+	return &cloudformation.CreateStackSetOutput{StackSetId: aws.String("id")}, nil
+}
+func (m *mockedStackSetClient) CreateStackInstances(in *cloudformation.CreateStackInstancesInput) (*cloudformation.CreateStackInstancesOutput, error) {
+	m.CreateStackInstancesInput = in
+	return &cloudformation.CreateStackInstancesOutput{OperationId: aws.String("op")}, nil
+}
+func (m *mockedStackSetClient) DescribeStackSetOperation(in *cloudformation.DescribeStackSetOperationInput) (*cloudformation.DescribeStackSetOperationOutput, error) {
+	status := m.OperationStatuses[m.describeCalls]
+	m.describeCalls++
+	return &cloudformation.DescribeStackSetOperationOutput{
+		StackSetOperation: &cloudformation.StackSetOperation{Status: aws.String(status)},
+	}, nil
+}
+
+func TestCreateStackSet(t *testing.T) {
+	// Forgot to define client
+	sError := StackSet{}
+	err := sError.CreateStackSet(nil)
+	if err.Error() != messageClientNotDefined {
+		t.Errorf("Expected error :%s, and got %s", messageClientNotDefined, err.Error())
+	}
+
+	mock := &mockedStackSetClient{}
+	s := NewStackSet(mock, "name", "url", []string{"CAPABILITY_IAM"})
+	err = s.CreateStackSet(generateParamers(2))
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if *mock.CreateStackSetInput.StackSetName != "name" || len(mock.CreateStackSetInput.Parameters) != 2 {
+		t.Errorf("Unexpected CreateStackSet input: %v", mock.CreateStackSetInput)
+	}
+}
+
+func TestCreateStackInstances(t *testing.T) {
+	stackSetPollInterval = 0
+
+	// Test success call
+	mock := &mockedStackSetClient{OperationStatuses: []string{"RUNNING", "SUCCEEDED"}}
+	s := NewStackSet(mock, "name", "url", []string{})
+	err := s.CreateStackInstances([]string{"111111111111"}, []string{"us-east-1", "eu-west-1"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(mock.CreateStackInstancesInput.Regions) != 2 {
+		t.Errorf("Two regions expected")
+	}
+	if mock.describeCalls != 2 {
+		t.Errorf("Expected 2 status checks, and got %d", mock.describeCalls)
+	}
+
+	// Test failed operation
+	mock = &mockedStackSetClient{OperationStatuses: []string{"FAILED"}}
+	s = NewStackSet(mock, "name", "url", []string{})
+	err = s.CreateStackInstances([]string{"111111111111"}, []string{"us-east-1"})
+	if err == nil {
+		t.Errorf("Expected error for failed operation")
+	}
+}
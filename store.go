@@ -2,8 +2,10 @@ package awsutils
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
@@ -45,3 +47,29 @@ func (s *Store) PutParameter(keyname, value string) error {
 	_, err := s.ssmClient.PutParameter(input)
 	return err
 }
+
+const ssmReferencePrefix = "ssm:"
+
+//ResolveSSMReferences ... returns a copy of parameters where every "ssm:/path" value is replaced by the value stored in SSM
+func ResolveSSMReferences(region string, parameters map[string]string) (map[string]string, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	}))
+	return resolveSSMReferences(ssm.New(sess), parameters)
+}
+func resolveSSMReferences(client ssmiface.SSMAPI, parameters map[string]string) (map[string]string, error) {
+	store := NewStore(client)
+	resolved := make(map[string]string)
+	for key, value := range parameters {
+		if !strings.HasPrefix(value, ssmReferencePrefix) {
+			resolved[key] = value
+			continue
+		}
+		param, err := store.GetParameter(strings.TrimPrefix(value, ssmReferencePrefix))
+		if err != nil {
+			return nil, err
+		}
+		resolved[key] = aws.StringValue(param)
+	}
+	return resolved, nil
+}
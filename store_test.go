@@ -0,0 +1,59 @@
+package awsutils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+/*Mock stuff*/
+type mockedSSMClient struct {
+	ssmiface.SSMAPI
+	Values map[string]string
+}
+
+func (m *mockedSSMClient) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	value, ok := m.Values[*in.Name]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Value: aws.String(value)}}, nil
+}
+
+func (m *mockedSSMClient) GetParameters(in *ssm.GetParametersInput) (*ssm.GetParametersOutput, error) {
+	out := &ssm.GetParametersOutput{}
+	for _, name := range in.Names {
+		if value, ok := m.Values[*name]; ok {
+			out.Parameters = append(out.Parameters, &ssm.Parameter{Name: name, Value: aws.String(value)})
+		} else {
+			out.InvalidParameters = append(out.InvalidParameters, name)
+		}
+	}
+	return out, nil
+}
+
+func TestResolveSSMReferences(t *testing.T) {
+	mock := &mockedSSMClient{Values: map[string]string{"/app/db/password": "secret"}}
+	parameters := map[string]string{
+		"DbPassword": "ssm:/app/db/password",
+		"Env":        "dev",
+	}
+	resolved, err := resolveSSMReferences(mock, parameters)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if resolved["DbPassword"] != "secret" || resolved["Env"] != "dev" {
+		t.Errorf("Unexpected resolved parameters: %v", resolved)
+	}
+	if parameters["DbPassword"] != "ssm:/app/db/password" {
+		t.Errorf("The input parameters should not be modified")
+	}
+
+	_, err = resolveSSMReferences(mock, map[string]string{"Missing": "ssm:/missing"})
+	if err == nil {
+		t.Errorf("Expected error for missing SSM parameter")
+	}
+}
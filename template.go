@@ -0,0 +1,274 @@
+package awsutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// templateParameter holds the constraints of a template parameter.
+type templateParameter struct {
+	Type          string        `json:"Type"`
+	MinLength     interface{}   `json:"MinLength"`
+	MaxLength     interface{}   `json:"MaxLength"`
+	AllowedValues []interface{} `json:"AllowedValues"`
+}
+
+type templateDocument struct {
+	Parameters map[string]templateParameter `json:"Parameters"`
+	Metadata   json.RawMessage              `json:"Metadata"`
+}
+
+// templateInterface is the AWS::CloudFormation::Interface metadata that groups the parameters in the console.
+type templateInterface struct {
+	Interface struct {
+		ParameterGroups []struct {
+			Parameters []string `json:"Parameters"`
+		} `json:"ParameterGroups"`
+	} `json:"AWS::CloudFormation::Interface"`
+}
+
+func parseTemplate(templateBody string) (*templateDocument, error) {
+	doc := &templateDocument{}
+	if err := json.Unmarshal([]byte(templateBody), doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// parameterGroupOrder returns the parameters in the order of the AWS::CloudFormation::Interface groups of the
+// template metadata, nil when there are none.
+func parameterGroupOrder(metadata []byte) []string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	ti := templateInterface{}
+	if err := json.Unmarshal(metadata, &ti); err != nil {
+		return nil
+	}
+	var order []string
+	for _, group := range ti.Interface.ParameterGroups {
+		order = append(order, group.Parameters...)
+	}
+	return order
+}
+
+// sortByOrder sorts keys by their position in order, the keys not in order go last alphabetically.
+func sortByOrder(keys, order []string) {
+	position := make(map[string]int)
+	for i, key := range order {
+		if _, ok := position[key]; !ok {
+			position[key] = i
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, iok := position[keys[i]]
+		pj, jok := position[keys[j]]
+		switch {
+		case iok && jok:
+			return pi < pj
+		case iok != jok:
+			return iok
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+// isJSONTemplate tells if the template body is JSON rather than YAML.
+func isJSONTemplate(templateBody string) bool {
+	return strings.HasPrefix(strings.TrimSpace(templateBody), "{")
+}
+
+//ValidateParameterConstraints ... checks the given values against the MinLength, MaxLength and AllowedValues
+//constraints declared in a template body. Only JSON templates are supported, a YAML body returns an error.
+//Lengths are counted in characters, as CloudFormation does
+func ValidateParameterConstraints(templateBody string, parameters map[string]string) error {
+	if !isJSONTemplate(templateBody) {
+		return fmt.Errorf("Only JSON templates can be validated locally")
+	}
+	doc, err := parseTemplate(templateBody)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	violations := make([]string, 0)
+	for _, key := range keys {
+		constraints, ok := doc.Parameters[key]
+		if !ok {
+			continue
+		}
+		for _, violation := range constraints.check(parameters[key]) {
+			violations = append(violations, key+": "+violation)
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid: [%s]", strings.Join(violations, ","))
+}
+func (p templateParameter) check(value string) []string {
+	violations := make([]string, 0)
+	length := utf8.RuneCountInString(value)
+	if min, ok := toInt(p.MinLength); ok && length < min {
+		violations = append(violations, fmt.Sprintf("MinLength %d", min))
+	}
+	if max, ok := toInt(p.MaxLength); ok && length > max {
+		violations = append(violations, fmt.Sprintf("MaxLength %d", max))
+	}
+	if len(p.AllowedValues) > 0 {
+		allowed := make([]string, 0, len(p.AllowedValues))
+		found := false
+		for _, v := range p.AllowedValues {
+			s := fmt.Sprint(v)
+			allowed = append(allowed, s)
+			if s == value {
+				found = true
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("AllowedValues [%s]", strings.Join(allowed, "|")))
+		}
+	}
+	return violations
+}
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case string:
+		i, err := strconv.Atoi(n)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+//LoadTemplateFromFile ... reads a local template, to be used as Stack.TemplateBody
+func LoadTemplateFromFile(path string) (string, error) {
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("Template file not found: %s", path)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return "", fmt.Errorf("Template file is empty: %s", path)
+	}
+	return string(body), nil
+}
+
+//S3TemplateURL ... builds the virtual-hosted style URL of a template stored in S3
+func S3TemplateURL(bucket, key, region string) string {
+	if region == "" || region == "us-east-1" {
+		return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket, key)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, key)
+}
+
+//S3TemplateURLPathStyle ... builds the path style URL (<endpoint>/<bucket>/<key>) of a template,
+//as required by some S3 compatible stores. The scheme of the endpoint is kept, https when it has none
+func S3TemplateURLPathStyle(endpoint, bucket, key string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, key)
+	}
+	return fmt.Sprintf("%s://%s%s/%s/%s", u.Scheme, u.Host, strings.TrimSuffix(u.Path, "/"), bucket, key)
+}
+
+// virtualHostedS3Host matches the host of a virtual-hosted style S3 URL, the bucket is everything before
+// the S3 endpoint, so that dotted bucket names such as logs.s3archive are kept whole.
+var virtualHostedS3Host = regexp.MustCompile(`^(.+)\.s3(?:[.-][a-z0-9-]+)*\.amazonaws\.com(?:\.cn)?$`)
+
+// parseS3TemplateURL returns the bucket and key of a virtual-hosted or path style S3 URL.
+func parseS3TemplateURL(templateURL string) (string, string, error) {
+	u, err := url.Parse(templateURL)
+	if err != nil {
+		return "", "", err
+	}
+	host := u.Hostname()
+	path := strings.TrimPrefix(u.Path, "/")
+	if match := virtualHostedS3Host.FindStringSubmatch(host); match != nil {
+		return match[1], path, nil
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Not an S3 object URL: %s", templateURL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// templateResource is a resource of the templates built by TemplateBuilder.
+type templateResource struct {
+	Type       string                 `json:"Type"`
+	Properties map[string]interface{} `json:"Properties,omitempty"`
+}
+
+//TemplateBuilder ... builds a minimal JSON template from Go values, to be used as Stack.TemplateBody
+type TemplateBuilder struct {
+	resources map[string]templateResource
+	err       error
+}
+
+//AddResource ... adds a resource to the template, an invalid or repeated logical id is reported by Build
+func (t *TemplateBuilder) AddResource(logicalID, resourceType string, properties map[string]interface{}) {
+	if t.resources == nil {
+		t.resources = make(map[string]templateResource)
+	}
+	if t.err != nil {
+		return
+	}
+	if !isAlphanumeric(logicalID) {
+		t.err = fmt.Errorf("Invalid logical id %q: only letters and digits are allowed", logicalID)
+		return
+	}
+	if _, ok := t.resources[logicalID]; ok {
+		t.err = fmt.Errorf("Duplicated logical id %s", logicalID)
+		return
+	}
+	t.resources[logicalID] = templateResource{Type: resourceType, Properties: properties}
+}
+
+//Build ... returns the template as JSON
+func (t *TemplateBuilder) Build() (string, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+	if len(t.resources) == 0 {
+		return "", fmt.Errorf("A template needs at least one resource")
+	}
+	doc := struct {
+		Version   string                      `json:"AWSTemplateFormatVersion"`
+		Resources map[string]templateResource `json:"Resources"`
+	}{"2010-09-09", t.resources}
+	body, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+func isAlphanumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
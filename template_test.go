@@ -0,0 +1,182 @@
+package awsutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const constrainedTemplate = `{
+	"Parameters": {
+		"Env": {"Type": "String", "AllowedValues": ["dev", "prod"]},
+		"Name": {"Type": "String", "MinLength": 2, "MaxLength": "5"}
+	}
+}`
+
+func TestValidateParameterConstraintsAllowedValues(t *testing.T) {
+	err := ValidateParameterConstraints(constrainedTemplate, map[string]string{"Env": "prod", "Name": "app"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	err = ValidateParameterConstraints(constrainedTemplate, map[string]string{"Env": "test"})
+	if err == nil || !strings.Contains(err.Error(), "Env: AllowedValues [dev|prod]") {
+		t.Errorf("Expected AllowedValues violation, and got %v", err)
+	}
+}
+
+func TestValidateParameterConstraintsLength(t *testing.T) {
+	err := ValidateParameterConstraints(constrainedTemplate, map[string]string{"Name": "a"})
+	if err == nil || !strings.Contains(err.Error(), "Name: MinLength 2") {
+		t.Errorf("Expected MinLength violation, and got %v", err)
+	}
+
+	err = ValidateParameterConstraints(constrainedTemplate, map[string]string{"Name": "toolong"})
+	if err == nil || !strings.Contains(err.Error(), "Name: MaxLength 5") {
+		t.Errorf("Expected MaxLength violation, and got %v", err)
+	}
+
+	// Lengths are in characters, not bytes
+	if err := ValidateParameterConstraints(constrainedTemplate, map[string]string{"Name": "éèêë"}); err != nil {
+		t.Errorf("Expected 4 characters to be valid, and got %v", err)
+	}
+}
+
+func TestValidateParameterConstraintsYAML(t *testing.T) {
+	err := ValidateParameterConstraints("Parameters:\n  Name:\n    Type: String\n", map[string]string{"Name": "a"})
+	if err == nil || !strings.Contains(err.Error(), "Only JSON templates") {
+		t.Errorf("Expected JSON only error, and got %v", err)
+	}
+}
+
+func TestLoadTemplateFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "template.json")
+
+	if _, err := LoadTemplateFromFile(path); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected not found error, and got %v", err)
+	}
+
+	ioutil.WriteFile(path, []byte(" \n"), 0644)
+	if _, err := LoadTemplateFromFile(path); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("Expected empty file error, and got %v", err)
+	}
+
+	ioutil.WriteFile(path, []byte(constrainedTemplate), 0644)
+	body, err := LoadTemplateFromFile(path)
+	if err != nil || body != constrainedTemplate {
+		t.Errorf("Expected the template body, and got %s %v", body, err)
+	}
+}
+
+func TestS3TemplateURL(t *testing.T) {
+	tests := map[string]string{
+		S3TemplateURL("bucket", "dir/template.json", "us-east-1"):                  "https://bucket.s3.amazonaws.com/dir/template.json",
+		S3TemplateURL("bucket", "template.json", "eu-west-1"):                      "https://bucket.s3.eu-west-1.amazonaws.com/template.json",
+		S3TemplateURLPathStyle("s3.local:9000", "bucket", "template.json"):         "https://s3.local:9000/bucket/template.json",
+		S3TemplateURLPathStyle("https://s3.local/", "bucket", "template.json"):     "https://s3.local/bucket/template.json",
+		S3TemplateURLPathStyle("http://localhost:4566", "bucket", "template.json"): "http://localhost:4566/bucket/template.json",
+	}
+	for got, expected := range tests {
+		if got != expected {
+			t.Errorf("Expected: %s, and got: %s", expected, got)
+		}
+	}
+}
+
+func TestParameterGroupOrder(t *testing.T) {
+	doc, err := parseTemplate(`{
+		"Metadata": {"AWS::CloudFormation::Interface": {"ParameterGroups": [
+			{"Parameters": ["Env"]},
+			{"Parameters": ["Vpc", "Subnet"]}
+		]}},
+		"Parameters": {"Env": {"Type": "String"}, "Vpc": {"Type": "String"}, "Subnet": {"Type": "String"}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := parameterGroupOrder(doc.Metadata)
+	if strings.Join(order, ",") != "Env,Vpc,Subnet" {
+		t.Errorf("Unexpected order: %v", order)
+	}
+
+	keys := []string{"Zone", "Subnet", "Alpha", "Env"}
+	sortByOrder(keys, order)
+	if strings.Join(keys, ",") != "Env,Subnet,Alpha,Zone" {
+		t.Errorf("Unexpected sorted keys: %v", keys)
+	}
+
+	if order := parameterGroupOrder(nil); order != nil {
+		t.Errorf("Expected no order without metadata, and got %v", order)
+	}
+}
+
+func TestParseS3TemplateURL(t *testing.T) {
+	tests := map[string][2]string{
+		"https://bucket.s3.amazonaws.com/dir/template.json":           {"bucket", "dir/template.json"},
+		"https://bucket.s3.eu-west-1.amazonaws.com/template.json":     {"bucket", "template.json"},
+		"https://s3.eu-west-1.amazonaws.com/bucket/dir/template.json": {"bucket", "dir/template.json"},
+		"https://s3.local:9000/bucket/template.json":                  {"bucket", "template.json"},
+		"https://logs.s3archive.s3.amazonaws.com/template.json":       {"logs.s3archive", "template.json"},
+		"https://my.bucket.s3-eu-west-1.amazonaws.com/template.json":  {"my.bucket", "template.json"},
+	}
+	for templateURL, expected := range tests {
+		bucket, key, err := parseS3TemplateURL(templateURL)
+		if err != nil || bucket != expected[0] || key != expected[1] {
+			t.Errorf("%s: expected %v, and got %s %s %v", templateURL, expected, bucket, key, err)
+		}
+	}
+	if _, _, err := parseS3TemplateURL("https://example.com/"); err == nil {
+		t.Errorf("Expected error for a URL without key")
+	}
+}
+
+func TestTemplateBuilder(t *testing.T) {
+	builder := TemplateBuilder{}
+	builder.AddResource("Bucket", "AWS::S3::Bucket", map[string]interface{}{"BucketName": "data"})
+	builder.AddResource("Queue", "AWS::SQS::Queue", nil)
+	body, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		AWSTemplateFormatVersion string
+		Resources                map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("Invalid JSON %s: %s", body, err)
+	}
+	if doc.AWSTemplateFormatVersion != "2010-09-09" || len(doc.Resources) != 2 {
+		t.Errorf("Unexpected template: %s", body)
+	}
+	bucket := doc.Resources["Bucket"]
+	if bucket["Type"] != "AWS::S3::Bucket" || bucket["Properties"].(map[string]interface{})["BucketName"] != "data" {
+		t.Errorf("Unexpected bucket: %v", bucket)
+	}
+	if _, ok := doc.Resources["Queue"]["Properties"]; ok || doc.Resources["Queue"]["Type"] != "AWS::SQS::Queue" {
+		t.Errorf("Unexpected queue: %v", doc.Resources["Queue"])
+	}
+
+	// Invalid templates
+	empty := TemplateBuilder{}
+	if _, err := empty.Build(); err == nil {
+		t.Errorf("Expected error for a template without resources")
+	}
+	builder.AddResource("Bucket", "AWS::S3::Bucket", nil)
+	if _, err := builder.Build(); err == nil || !strings.Contains(err.Error(), "Duplicated logical id Bucket") {
+		t.Errorf("Expected duplicated id error, and got %v", err)
+	}
+	invalid := TemplateBuilder{}
+	invalid.AddResource("my-bucket", "AWS::S3::Bucket", nil)
+	if _, err := invalid.Build(); err == nil || !strings.Contains(err.Error(), "Invalid logical id") {
+		t.Errorf("Expected invalid id error, and got %v", err)
+	}
+}